@@ -0,0 +1,224 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	DefaultPath = "/var/lib/rancher/longhorn/audit.log"
+	// The log is rotated when it would grow past maxSize, keeping up to maxBackups rotated files as <path>.1 (newest)
+	// to <path>.<maxBackups>
+	maxSize    = 10 * 1024 * 1024
+	maxBackups = 5
+
+	// HTTP header that clients of the driver's API put the caller of the operation in
+	CallerHeader = "X-Longhorn-Caller"
+
+	ResultSuccess = "success"
+	ResultError   = "error"
+)
+
+// Entry records one volume operation
+type Entry struct {
+	Time      time.Time         `json:"time"`
+	Operation string            `json:"operation"`
+	Volume    string            `json:"volume"`
+	Caller    string            `json:"caller"`
+	Options   map[string]string `json:"options,omitempty"`
+	Duration  float64           `json:"durationSeconds"`
+	Result    string            `json:"result"`
+	Error     string            `json:"error,omitempty"`
+}
+
+type callerKey struct{}
+
+// WithCaller returns a context that records how an operation was requested, such as "docker" or the ID of the Cattle
+// event that led to it
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+func Caller(ctx context.Context) string {
+	if caller, ok := ctx.Value(callerKey{}).(string); ok {
+		return caller
+	}
+	return "unknown"
+}
+
+// Log is an append-only JSON lines file of entries that is rotated by size. A nil Log discards entries.
+type Log struct {
+	mutex      sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func Open(path string) (*Log, error) {
+	l := &Log{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("Couldn't open audit log %v. Error: %v", l.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// Record writes an entry for an operation that started at start and returned err. It's meant to be deferred with a
+// pointer to the caller's named error result. Failing to write is logged rather than failing the operation.
+func (l *Log) Record(ctx context.Context, operation, volume string, options map[string]string, start time.Time, err *error) {
+	if l == nil {
+		return
+	}
+
+	e := Entry{
+		Time:      start.UTC(),
+		Operation: operation,
+		Volume:    volume,
+		Caller:    Caller(ctx),
+		Options:   options,
+		Duration:  time.Since(start).Seconds(),
+		Result:    ResultSuccess,
+	}
+	if err != nil && *err != nil {
+		e.Result = ResultError
+		e.Error = (*err).Error()
+	}
+
+	if err := l.Write(e); err != nil {
+		logrus.Warnf("Couldn't write audit log entry %+v: %v", e, err)
+	}
+}
+
+// Write appends the entry and syncs it to disk
+func (l *Log) Write(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	for i := l.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(backupPath(l.path, i), backupPath(l.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(l.path, backupPath(l.path, 1)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func (l *Log) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.file.Close()
+}
+
+func backupPath(path string, i int) string {
+	return fmt.Sprintf("%v.%d", path, i)
+}
+
+// Filter selects entries. Empty fields match every entry.
+type Filter struct {
+	Volume    string
+	Operation string
+	// Matches entries whose caller contains it
+	Caller     string
+	Since      time.Time
+	ErrorsOnly bool
+}
+
+func (f Filter) matches(e Entry) bool {
+	return (f.Volume == "" || e.Volume == f.Volume) &&
+		(f.Operation == "" || e.Operation == f.Operation) &&
+		(f.Caller == "" || strings.Contains(e.Caller, f.Caller)) &&
+		!e.Time.Before(f.Since) &&
+		(!f.ErrorsOnly || e.Result == ResultError)
+}
+
+// Query returns the entries in the log at path, including rotated files, that match the filter, oldest first
+func Query(path string, filter Filter) ([]Entry, error) {
+	files := []string{}
+	for i := maxBackups; i >= 1; i-- {
+		files = append(files, backupPath(path, i))
+	}
+	files = append(files, path)
+
+	entries := []Entry{}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			e := Entry{}
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				// A line may have been cut short by a crash
+				logrus.Warnf("Skipping unreadable audit log entry in %v: %v", file, err)
+				continue
+			}
+			if filter.matches(e) {
+				entries = append(entries, e)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
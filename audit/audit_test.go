@@ -0,0 +1,158 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestLog(t *testing.T) (*Log, string) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "audit.log")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, path
+}
+
+func TestRecord(t *testing.T) {
+	l, path := openTestLog(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer l.Close()
+
+	start := time.Now()
+	var err error
+	l.Record(WithCaller(context.Background(), "docker"), "create", "vol1", map[string]string{"size": "10g"}, start, &err)
+	err = fmt.Errorf("boom")
+	l.Record(context.Background(), "delete", "vol1", nil, start, &err)
+
+	entries, err := Query(path, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %v", entries)
+	}
+	e := entries[0]
+	if e.Operation != "create" || e.Volume != "vol1" || e.Caller != "docker" || e.Options["size"] != "10g" ||
+		e.Result != ResultSuccess || e.Error != "" {
+		t.Fatalf("Unexpected entry %+v", e)
+	}
+	e = entries[1]
+	if e.Operation != "delete" || e.Caller != "unknown" || e.Result != ResultError || e.Error != "boom" {
+		t.Fatalf("Unexpected entry %+v", e)
+	}
+
+	// A nil log discards entries
+	var nilLog *Log
+	nilLog.Record(context.Background(), "create", "vol1", nil, start, &err)
+}
+
+func TestRotate(t *testing.T) {
+	l, path := openTestLog(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer l.Close()
+	l.maxSize = 200
+	l.maxBackups = 2
+
+	for i := 0; i < 10; i++ {
+		if err := l.Write(Entry{Operation: "mount", Volume: fmt.Sprintf("vol%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, p := range []string{path, backupPath(path, 1), backupPath(path, 2)} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > l.maxSize {
+			t.Fatalf("%v is %v bytes, more than the maximum of %v", p, info.Size(), l.maxSize)
+		}
+	}
+	if _, err := os.Stat(backupPath(path, 3)); !os.IsNotExist(err) {
+		t.Fatalf("Expected only %v rotated files, got %v: %v", l.maxBackups, backupPath(path, 3), err)
+	}
+
+	entries, err := Query(path, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 || entries[len(entries)-1].Volume != "vol9" {
+		t.Fatalf("Expected the newest entry last, got %v", entries)
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Volume <= entries[i-1].Volume {
+			t.Fatalf("Entries out of order: %v", entries)
+		}
+	}
+}
+
+func TestQueryFilter(t *testing.T) {
+	l, path := openTestLog(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer l.Close()
+
+	now := time.Now().UTC()
+	for _, e := range []Entry{
+		{Time: now.Add(-2 * time.Hour), Operation: "create", Volume: "vol1", Caller: "docker", Result: ResultSuccess},
+		{Time: now.Add(-time.Hour), Operation: "mount", Volume: "vol1", Caller: "docker", Result: ResultError},
+		{Time: now, Operation: "create", Volume: "vol2", Caller: "cattle event 1e1 (storage.volume.remove)", Result: ResultSuccess},
+	} {
+		if err := l.Write(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		filter   Filter
+		expected int
+	}{
+		{Filter{}, 3},
+		{Filter{Volume: "vol1"}, 2},
+		{Filter{Operation: "create"}, 2},
+		{Filter{Caller: "1e1"}, 1},
+		{Filter{Since: now.Add(-90 * time.Minute)}, 2},
+		{Filter{ErrorsOnly: true}, 1},
+		{Filter{Volume: "vol1", Operation: "create"}, 1},
+	} {
+		entries, err := Query(path, test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != test.expected {
+			t.Fatalf("Expected %v entries for %+v, got %v", test.expected, test.filter, entries)
+		}
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2016, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	since, err := parseSince("", now)
+	if err != nil || !since.IsZero() {
+		t.Fatalf("Expected zero time, got %v, %v", since, err)
+	}
+
+	since, err = parseSince("24h", now)
+	if err != nil || !since.Equal(now.Add(-24*time.Hour)) {
+		t.Fatalf("Unexpected since %v, %v", since, err)
+	}
+
+	since, err = parseSince("2016-05-01T00:00:00Z", now)
+	if err != nil || !since.Equal(time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected since %v, %v", since, err)
+	}
+
+	if _, err := parseSince("yesterday", now); err == nil {
+		t.Fatal("Expected error")
+	}
+}
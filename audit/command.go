@@ -0,0 +1,83 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+)
+
+var Command = cli.Command{
+	Name:   "audit",
+	Usage:  "Query the audit log of volume operations on this host",
+	Action: query,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "file",
+			Value: DefaultPath,
+			Usage: "audit log to read. Rotated files next to it are read too",
+		},
+		cli.StringFlag{
+			Name:  "volume",
+			Usage: "only show operations on this volume",
+		},
+		cli.StringFlag{
+			Name:  "operation",
+			Usage: "only show this operation, such as create, mount, remove (from this host) or delete (destroying its data)",
+		},
+		cli.StringFlag{
+			Name:  "caller",
+			Usage: "only show operations whose caller contains this, such as docker, http or a Cattle event ID",
+		},
+		cli.StringFlag{
+			Name:  "since",
+			Usage: "only show operations since this RFC 3339 time or this long ago, such as 24h",
+		},
+		cli.BoolFlag{
+			Name:  "errors",
+			Usage: "only show operations that failed",
+		},
+	},
+}
+
+func query(c *cli.Context) {
+	since, err := parseSince(c.String("since"), time.Now())
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	entries, err := Query(c.String("file"), Filter{
+		Volume:     c.String("volume"),
+		Operation:  c.String("operation"),
+		Caller:     c.String("caller"),
+		Since:      since,
+		ErrorsOnly: c.Bool("errors"),
+	})
+	if err != nil {
+		logrus.Fatalf("Error reading audit log: %v", err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for _, e := range entries {
+		if err := encoder.Encode(e); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+}
+
+func parseSince(since string, now time.Time) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(since); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid since %q. Must be a duration such as 24h or an RFC 3339 time.", since)
+	}
+	return t, nil
+}
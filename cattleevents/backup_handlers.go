@@ -1,11 +1,12 @@
 package cattleevents
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/mitchellh/mapstructure"
-	"github.com/rancher/docker-longhorn-driver/util"
+	"github.com/rancher/docker-longhorn-driver/longhorn"
 	revents "github.com/rancher/go-machine-service/events"
 	"github.com/rancher/go-rancher/client"
 	"strings"
@@ -15,41 +16,24 @@ import (
 type backupHandlers struct {
 }
 
-func (h *backupHandlers) Create(event *revents.Event, cli *client.RancherClient) error {
+func (h *backupHandlers) Create(ctx context.Context, event *revents.Event, cli *client.RancherClient) error {
 	logrus.Infof("Received event: Name: %s, Event Id: %s, Resource Id: %s", event.Name, event.ID, event.ResourceID)
 	backup, err := h.decodeEventBackup(event)
 	if err != nil {
 		return err
 	}
 
-	volClient := newVolumeClient(&backup.Snapshot)
+	volClient := longhorn.NewVolumeClient(backup.Snapshot.Volume.Name)
 
 	logrus.Infof("Creating backup %v", backup.UUID)
 
 	target := newBackupTarget(backup)
-	status, err := volClient.createBackup(backup.Snapshot.UUID, backup.UUID, target)
+	status, err := volClient.CreateBackup(ctx, backup.Snapshot.UUID, backup.UUID, target)
 	if err != nil {
 		return err
 	}
 
-	err = util.Backoff(time.Hour*12, fmt.Sprintf("Failed waiting for restore to backup :%s", "somedir"), func() (bool, error) {
-		s, err := volClient.reloadStatus(status)
-		if err != nil {
-			return false, err
-		}
-		if s.State == "done" {
-			return true, nil
-		} else if s.State == "error" {
-			return false, fmt.Errorf("Backup create failed. Status: %v", s.Message)
-		}
-		return false, nil
-	})
-
-	if err != nil {
-		return err
-	}
-
-	status, err = volClient.reloadStatus(status)
+	status, err = volClient.WaitForStatus(ctx, status, time.Hour*12, fmt.Sprintf("backup %v", backup.UUID))
 	if err != nil {
 		return err
 	}
@@ -68,7 +52,7 @@ func (h *backupHandlers) Create(event *revents.Event, cli *client.RancherClient)
 
 }
 
-func (h *backupHandlers) Delete(event *revents.Event, cli *client.RancherClient) error {
+func (h *backupHandlers) Delete(ctx context.Context, event *revents.Event, cli *client.RancherClient) error {
 	logrus.Infof("Received event: Name: %s, Event Id: %s, Resource Id: %s", event.Name, event.ID, event.ResourceID)
 
 	backup, err := h.decodeEventBackup(event)
@@ -76,11 +60,11 @@ func (h *backupHandlers) Delete(event *revents.Event, cli *client.RancherClient)
 		return err
 	}
 
-	volClient := newVolumeClient(&backup.Snapshot)
+	volClient := longhorn.NewVolumeClient(backup.Snapshot.Volume.Name)
 
 	logrus.Infof("Removing backup %v", backup.UUID)
 	target := newBackupTarget(backup)
-	if _, err := volClient.removeBackup(backup.Snapshot.UUID, backup.UUID, backup.URI, target); err != nil {
+	if _, err := volClient.RemoveBackup(ctx, backup.Snapshot.UUID, backup.UUID, backup.URI, target); err != nil {
 		return err
 	}
 
@@ -96,8 +80,8 @@ func (h *backupHandlers) decodeEventBackup(event *revents.Event) (*eventBackup,
 	return nil, fmt.Errorf("Event doesn't contain backup data. Event: %#v.", event)
 }
 
-func newBackupTarget(backup *eventBackup) backupTarget {
-	return backupTarget{
+func newBackupTarget(backup *eventBackup) longhorn.BackupTarget {
+	return longhorn.BackupTarget{
 		Name:      backup.BackupTarget.Name,
 		UUID:      backup.BackupTarget.UUID,
 		NFSConfig: backup.BackupTarget.Data.Fields.NFSConfig,
@@ -0,0 +1,97 @@
+package cattleevents
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/rancher/docker-longhorn-driver/audit"
+	"github.com/rancher/docker-longhorn-driver/util"
+)
+
+const unixURLPrefix = "unix://"
+
+// DriverAPIConfig describes how to reach the volume driver's management API
+type DriverAPIConfig struct {
+	// http://, https:// or unix:// URL of the API
+	URL   string
+	Token string
+	// Client certificate and key to present over TLS and the CA that signs the API's certificate
+	TLSCert string
+	TLSKey  string
+	TLSCA   string
+}
+
+type driverClient struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func newDriverClient(config DriverAPIConfig) (*driverClient, error) {
+	transport := &http.Transport{}
+	baseURL := strings.TrimSuffix(config.URL, "/")
+
+	if strings.HasPrefix(baseURL, unixURLPrefix) {
+		socket := strings.TrimPrefix(baseURL, unixURLPrefix)
+		transport.Dial = func(_, _ string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		}
+		// The host is ignored when dialing the socket
+		baseURL = "http://driver"
+	} else if strings.HasPrefix(baseURL, "https://") {
+		tlsConfig, err := util.NewTLSConfig(config.TLSCert, config.TLSKey, config.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &driverClient{
+		baseURL: baseURL,
+		token:   config.Token,
+		client:  &http.Client{Transport: transport},
+	}, nil
+}
+
+// do calls the API and returns an error including the response body if the response isn't a success
+func (c *driverClient) do(ctx context.Context, method, path string, body interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewBuffer(b)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set(audit.CallerHeader, audit.Caller(ctx))
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		content, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Unexpected response code %v. Body: %s", resp.StatusCode, content)
+	}
+	return nil
+}
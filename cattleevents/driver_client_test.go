@@ -0,0 +1,52 @@
+package cattleevents
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDriverClientOverSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "driver-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "api.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	var method, path, auth string
+	go http.Serve(listener, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		method, path, auth = r.Method, r.URL.RequestURI(), r.Header.Get("Authorization")
+		if r.URL.Query().Get("action") == "resize" {
+			rw.WriteHeader(http.StatusConflict)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+
+	client, err := newDriverClient(DriverAPIConfig{URL: "unix://" + socket, Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.do(context.Background(), http.MethodDelete, "/v1/volumes/foo", nil); err != nil {
+		t.Fatal(err)
+	}
+	if method != http.MethodDelete || path != "/v1/volumes/foo" || auth != "Bearer secret" {
+		t.Fatalf("Unexpected request: %v %v %q", method, path, auth)
+	}
+
+	if err := client.do(context.Background(), http.MethodPost, "/v1/volumes/foo?action=resize", map[string]string{"size": "1g"}); err == nil {
+		t.Fatal("Expected error for unsuccessful response")
+	}
+}
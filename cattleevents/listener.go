@@ -1,47 +1,111 @@
 package cattleevents
 
 import (
+	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/mitchellh/mapstructure"
 
+	"github.com/rancher/docker-longhorn-driver/audit"
+	"github.com/rancher/docker-longhorn-driver/longhorn"
+	"github.com/rancher/docker-longhorn-driver/metrics"
+	"github.com/rancher/docker-longhorn-driver/util"
 	revents "github.com/rancher/go-machine-service/events"
 	"github.com/rancher/go-rancher/client"
 )
 
 const (
-	deleteURL = "http://driver/v1/volumes/%s"
+	// Long enough for the 12 hour backup and restore waits to time out on their own
+	defaultEventTimeout = 13 * time.Hour
+	shutdownGracePeriod = 30 * time.Second
+
+	volumePath = "/v1/volumes/%s"
+	resizePath = "/v1/volumes/%s?action=resize"
 )
 
-func ConnectToEventStream(conf Config) error {
+// ConnectToEventStream handles Cattle events until the connection fails or ctx is cancelled. Handlers are given a
+// context that is cancelled on either or when the event times out.
+func ConnectToEventStream(ctx context.Context, conf Config) error {
 	logrus.Infof("Listening for cattle events")
 
 	nh := noopHandler{}
 	ph := PingHandler{}
-	volume := &volumeHandlers{}
+	driver, err := newDriverClient(conf.DriverAPI)
+	if err != nil {
+		return err
+	}
+
+	volume := &volumeHandlers{driver: driver}
 	snapshot := &snapshotHandlers{}
 	backup := &backupHandlers{}
 
+	timeout := conf.EventTimeout
+	if timeout == 0 {
+		timeout = defaultEventTimeout
+	}
+	h := &contextHandlers{
+		ctx:     ctx,
+		timeout: timeout,
+	}
+
 	eventHandlers := map[string]revents.EventHandler{
-		"storage.snapshot.create":          snapshot.Create,
-		"storage.snapshot.remove":          snapshot.Delete,
-		"storage.backup.create":            backup.Create,
-		"storage.backup.remove":            backup.Delete,
-		"storage.volume.remove":            volume.VolumeRemove,
-		"storage.volume.reverttosnapshot":  volume.RevertToSnapshot,
-		"storage.volume.restorefrombackup": volume.RestoreFromBackup,
+		"storage.snapshot.create":          h.wrap(snapshot.Create),
+		"storage.snapshot.remove":          h.wrap(snapshot.Delete),
+		"storage.backup.create":            h.wrap(backup.Create),
+		"storage.backup.remove":            h.wrap(backup.Delete),
+		"storage.volume.remove":            h.wrap(volume.VolumeRemove),
+		"storage.volume.resize":            h.wrap(volume.VolumeResize),
+		"storage.volume.reverttosnapshot":  h.wrap(volume.RevertToSnapshot),
+		"storage.volume.restorefrombackup": h.wrap(volume.RestoreFromBackup),
 		"storage.volume.activate":          nh.Handler,
 		"storage.volume.deactivate":        nh.Handler,
-		"ping": ph.Handler,
+		"ping":                             ph.Handler,
 	}
 
 	router, err := revents.NewEventRouter("", 0, conf.CattleURL, conf.CattleAccessKey, conf.CattleSecretKey, nil, eventHandlers, "", conf.WorkerCount)
 	if err != nil {
 		return err
 	}
-	err = router.StartWithoutCreate(nil)
-	return err
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- router.StartWithoutCreate(nil)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		if !util.WaitTimeout(&h.inflight, shutdownGracePeriod) {
+			logrus.Warnf("Event handlers still running at shutdown")
+		}
+		return ctx.Err()
+	}
+}
+
+type contextHandler func(ctx context.Context, event *revents.Event, cli *client.RancherClient) error
+
+// contextHandlers gives event handlers a context and tracks the ones in progress
+type contextHandlers struct {
+	ctx      context.Context
+	timeout  time.Duration
+	inflight sync.WaitGroup
+}
+
+func (h *contextHandlers) wrap(handler contextHandler) revents.EventHandler {
+	return func(event *revents.Event, cli *client.RancherClient) (err error) {
+		defer metrics.Observe("cattleevents", event.Name, time.Now(), &err)
+		h.inflight.Add(1)
+		defer h.inflight.Done()
+
+		ctx, cancel := context.WithTimeout(h.ctx, h.timeout)
+		defer cancel()
+		ctx = audit.WithCaller(ctx, fmt.Sprintf("cattle event %v (%v)", event.ID, event.Name))
+		return handler(ctx, event, cli)
+	}
 }
 
 type noopHandler struct{}
@@ -95,6 +159,7 @@ func decodeEvent(event *revents.Event, key string, target interface{}) error {
 type processData struct {
 	ProcessID  string `mapstructure:"processId"`
 	VolumeName string
+	Size       string
 }
 
 type eventBackup struct {
@@ -106,7 +171,7 @@ type eventBackup struct {
 		UUID string
 		Data struct {
 			Fields struct {
-				NFSConfig nfsConfig
+				NFSConfig longhorn.NFSConfig
 			}
 		}
 	}
@@ -125,4 +190,7 @@ type Config struct {
 	CattleAccessKey string
 	CattleSecretKey string
 	WorkerCount     int
+	DriverAPI       DriverAPIConfig
+	// How long a handler may take before its work is cancelled. Defaults to defaultEventTimeout.
+	EventTimeout time.Duration
 }
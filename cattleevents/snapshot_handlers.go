@@ -1,7 +1,9 @@
 package cattleevents
 
 import (
+	"context"
 	"github.com/Sirupsen/logrus"
+	"github.com/rancher/docker-longhorn-driver/longhorn"
 	revents "github.com/rancher/go-machine-service/events"
 	"github.com/rancher/go-rancher/client"
 )
@@ -9,7 +11,7 @@ import (
 type snapshotHandlers struct {
 }
 
-func (h *snapshotHandlers) Create(event *revents.Event, cli *client.RancherClient) error {
+func (h *snapshotHandlers) Create(ctx context.Context, event *revents.Event, cli *client.RancherClient) error {
 	logrus.Infof("Received event: Name: %s, Event Id: %s, Resource Id: %s", event.Name, event.ID, event.ResourceID)
 
 	snapshot := &eventSnapshot{}
@@ -18,23 +20,23 @@ func (h *snapshotHandlers) Create(event *revents.Event, cli *client.RancherClien
 		return err
 	}
 
-	volClient := newVolumeClient(snapshot)
+	volClient := longhorn.NewVolumeClient(snapshot.Volume.Name)
 
-	found, _ := volClient.getSnapshot(snapshot.UUID)
+	found, _ := volClient.GetSnapshot(ctx, snapshot.UUID)
 	if found != nil {
 		return reply("snapshot", event, cli)
 	}
 
 	logrus.Infof("Creating snapshot %v", snapshot.UUID)
 
-	if _, err := volClient.createSnapshot(snapshot.UUID); err != nil {
+	if _, err := volClient.CreateSnapshot(ctx, snapshot.UUID); err != nil {
 		return err
 	}
 
 	return reply("snapshot", event, cli)
 }
 
-func (h *snapshotHandlers) Delete(event *revents.Event, cli *client.RancherClient) error {
+func (h *snapshotHandlers) Delete(ctx context.Context, event *revents.Event, cli *client.RancherClient) error {
 	logrus.Infof("Received event: Name: %s, Event Id: %s, Resource Id: %s", event.Name, event.ID, event.ResourceID)
 
 	snapshot := &eventSnapshot{}
@@ -43,8 +45,8 @@ func (h *snapshotHandlers) Delete(event *revents.Event, cli *client.RancherClien
 		return err
 	}
 
-	volClient := newVolumeClient(snapshot)
-	if err := volClient.deleteSnapshot(snapshot.UUID); err != nil {
+	volClient := longhorn.NewVolumeClient(snapshot.Volume.Name)
+	if err := volClient.DeleteSnapshot(ctx, snapshot.UUID); err != nil {
 		return err
 	}
 
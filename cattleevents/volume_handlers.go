@@ -1,25 +1,24 @@
 package cattleevents
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/mitchellh/mapstructure"
 
-	"github.com/rancher/docker-longhorn-driver/driver"
-	"github.com/rancher/docker-longhorn-driver/util"
+	"github.com/rancher/docker-longhorn-driver/longhorn"
 	revents "github.com/rancher/go-machine-service/events"
 	"github.com/rancher/go-rancher/client"
 	"time"
 )
 
 type volumeHandlers struct {
-	daemon *driver.StorageDaemon
+	driver *driverClient
 }
 
-func (h *volumeHandlers) RevertToSnapshot(event *revents.Event, cli *client.RancherClient) error {
+func (h *volumeHandlers) RevertToSnapshot(ctx context.Context, event *revents.Event, cli *client.RancherClient) error {
 	logrus.Infof("Received event: Name: %s, Event Id: %s, Resource Id: %s", event.Name, event.ID, event.ResourceID)
 
 	snapshot := &eventSnapshot{}
@@ -28,11 +27,11 @@ func (h *volumeHandlers) RevertToSnapshot(event *revents.Event, cli *client.Ranc
 		return err
 	}
 
-	volClient := newVolumeClient(snapshot)
+	volClient := longhorn.NewVolumeClient(snapshot.Volume.Name)
 
 	logrus.Infof("Reverting to snapshot %v", snapshot.UUID)
 
-	_, err = volClient.revertToSnapshot(snapshot.UUID)
+	_, err = volClient.RevertToSnapshot(ctx, snapshot.UUID)
 	if err != nil {
 		return err
 	}
@@ -40,7 +39,7 @@ func (h *volumeHandlers) RevertToSnapshot(event *revents.Event, cli *client.Ranc
 	return reply("volume", event, cli)
 }
 
-func (h *volumeHandlers) RestoreFromBackup(event *revents.Event, cli *client.RancherClient) error {
+func (h *volumeHandlers) RestoreFromBackup(ctx context.Context, event *revents.Event, cli *client.RancherClient) error {
 	logrus.Infof("Received event: Name: %s, Event Id: %s, Resource Id: %s", event.Name, event.ID, event.ResourceID)
 
 	backup := &eventBackup{}
@@ -54,38 +53,24 @@ func (h *volumeHandlers) RestoreFromBackup(event *revents.Event, cli *client.Ran
 		return err
 	}
 
-	volClient := newVolumeClientFromName(pd.VolumeName)
+	volClient := longhorn.NewVolumeClient(pd.VolumeName)
 
 	logrus.Infof("Restoring from backup %v", backup.UUID)
 
 	target := newBackupTarget(backup)
-	status, err := volClient.restoreFromBackup(pd.ProcessID, backup.URI, target)
+	status, err := volClient.RestoreFromBackup(ctx, pd.ProcessID, backup.URI, target)
 	if err != nil {
 		return err
 	}
 
-	err = util.Backoff(time.Hour*12, fmt.Sprintf("Failed waiting for restore to backup: %v %v", backup.UUID, backup.URI),
-		func() (bool, error) {
-			s, err := volClient.reloadStatus(status)
-			if err != nil {
-				return false, err
-			}
-			if s.State == "done" {
-				return true, nil
-			} else if s.State == "error" {
-				return false, fmt.Errorf("Restore failed. Status: %v", s.Message)
-			}
-			return false, nil
-		})
-
-	if err != nil {
+	if _, err := volClient.WaitForStatus(ctx, status, time.Hour*12, fmt.Sprintf("restore from backup %v %v", backup.UUID, backup.URI)); err != nil {
 		return err
 	}
 
 	return reply("volume", event, cli)
 }
 
-func (h *volumeHandlers) VolumeRemove(event *revents.Event, cli *client.RancherClient) error {
+func (h *volumeHandlers) VolumeRemove(ctx context.Context, event *revents.Event, cli *client.RancherClient) error {
 	logrus.Infof("Received event: Name: %s, Event Id: %s, Resource Id: %s", event.Name, event.ID, event.ResourceID)
 
 	vspm := &struct {
@@ -103,20 +88,28 @@ func (h *volumeHandlers) VolumeRemove(event *revents.Event, cli *client.RancherC
 
 	name := vspm.VSPM.V.Name
 	if name != "" {
-		req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf(deleteURL, name), nil)
-		if err != nil {
-			return fmt.Errorf("Error building delete request for %v: %v", name, err)
-		}
-
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
+		if err := h.driver.do(ctx, http.MethodDelete, fmt.Sprintf(volumePath, name), nil); err != nil {
 			return fmt.Errorf("Error calling volume delete API for %v: %v", name, err)
 		}
+	}
 
-		if resp.StatusCode >= 300 {
-			body, _ := ioutil.ReadAll(resp.Body)
-			return fmt.Errorf("Unexpected repsonse code %v deleting %v. Body: %s", resp.StatusCode, name, body)
-		}
+	return reply("volume", event, cli)
+}
+
+func (h *volumeHandlers) VolumeResize(ctx context.Context, event *revents.Event, cli *client.RancherClient) error {
+	logrus.Infof("Received event: Name: %s, Event Id: %s, Resource Id: %s", event.Name, event.ID, event.ResourceID)
+
+	pd := &processData{}
+	if err := decodeEvent(event, "processData", pd); err != nil {
+		return err
+	}
+
+	if pd.VolumeName == "" || pd.Size == "" {
+		return fmt.Errorf("Resize event must include volume name and size. Event: %#v.", event)
+	}
+
+	if err := h.driver.do(ctx, http.MethodPost, fmt.Sprintf(resizePath, pd.VolumeName), map[string]string{"size": pd.Size}); err != nil {
+		return fmt.Errorf("Error calling volume resize API for %v: %v", pd.VolumeName, err)
 	}
 
 	return reply("volume", event, cli)
@@ -10,15 +10,83 @@ import (
 	rancherClient "github.com/rancher/go-rancher/client"
 
 	"github.com/rancher/docker-longhorn-driver/driver"
+	"github.com/rancher/docker-longhorn-driver/metrics"
 	"github.com/rancher/docker-longhorn-driver/util"
 	"io/ioutil"
+	"os"
 	"os/exec"
+	"time"
 )
 
 var Command = cli.Command{
 	Name:   "volumedriver",
 	Usage:  "Start the docker volume driver",
 	Action: start,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "reconcile-dry-run",
+			Usage: "only log what startup reconciliation of mounts and local cache would change",
+		},
+		cli.StringFlag{
+			Name:  "default-frontend",
+			Value: "tcmu",
+			Usage: "Longhorn frontend of volumes created without the frontend option: tcmu or tgt (iSCSI)",
+		},
+		cli.IntFlag{
+			Name:   "host-max-provisioned-gb",
+			Usage:  "maximum total size in GB of the volumes whose controller is on this host. 0 for no limit",
+			EnvVar: "HOST_MAX_PROVISIONED_GB",
+		},
+		cli.IntFlag{
+			Name:   "host-max-volume-gb",
+			Usage:  "maximum size in GB of a volume created on this host. 0 for no limit",
+			EnvVar: "HOST_MAX_VOLUME_GB",
+		},
+		cli.IntFlag{
+			Name:   "driver-max-provisioned-gb",
+			Usage:  "maximum total size in GB of all of the driver's volumes. 0 for no limit",
+			EnvVar: "DRIVER_MAX_PROVISIONED_GB",
+		},
+		cli.IntFlag{
+			Name:   "driver-max-volume-gb",
+			Usage:  "maximum size in GB of any of the driver's volumes. 0 for no limit",
+			EnvVar: "DRIVER_MAX_VOLUME_GB",
+		},
+		cli.IntFlag{
+			Name:  "request-timeout",
+			Usage: "seconds after which Docker volume requests are aborted, rolling back partially created volumes. 0 for no limit",
+		},
+		cli.IntFlag{
+			Name:  "shutdown-grace-period",
+			Value: 30,
+			Usage: "seconds to wait on shutdown for cancelled operations to roll back. Rollbacks still in progress are finished on the next start",
+		},
+		cli.StringFlag{
+			Name:  "api-listen",
+			Value: ":80",
+			Usage: "address the management API listens on. Requires --driver-api-token or --api-tls-cert with --driver-api-ca. Empty to only serve on --api-socket",
+		},
+		cli.StringFlag{
+			Name:  "api-socket",
+			Usage: "unix socket to also serve the management API on",
+		},
+		cli.StringFlag{
+			Name:  "api-tls-cert",
+			Usage: "certificate to serve the management API over TLS with",
+		},
+		cli.StringFlag{
+			Name:  "api-tls-key",
+			Usage: "key of --api-tls-cert",
+		},
+		cli.StringFlag{
+			Name:  "compose-template",
+			Usage: "file with the docker-compose template for volume stacks. Overrides VOLUME_STACK_TEMPLATE in the driver service's metadata",
+		},
+		cli.StringFlag{
+			Name:  "compose-template-version",
+			Usage: "version recorded in stacks created from the compose template. Derived from the template if not set",
+		},
+	},
 }
 
 func start(c *cli.Context) {
@@ -47,17 +115,83 @@ func start(c *cli.Context) {
 		logrus.Fatalf("Unable to write spec file: %v", err)
 	}
 
-	sd, err := driver.NewStorageDaemon(md.ContainerName, md.DriverName, md.Image, client)
+	templateContent, templateVersion := md.Template, md.TemplateVersion
+	if file := c.String("compose-template"); file != "" {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			logrus.Fatalf("Unable to read compose template: %v", err)
+		}
+		templateContent, templateVersion = string(content), c.String("compose-template-version")
+	} else if v := c.String("compose-template-version"); v != "" {
+		templateVersion = v
+	}
+
+	template, err := driver.LoadStackTemplate(templateContent, templateVersion)
+	if err != nil {
+		logrus.Fatalf("Invalid compose template: %v", err)
+	}
+	logrus.Infof("Using compose template version %v", template.Version)
+
+	quotas := driver.Quotas{
+		Host: driver.Quota{
+			MaxProvisionedGB: int64(c.Int("host-max-provisioned-gb")),
+			MaxVolumeGB:      int64(c.Int("host-max-volume-gb")),
+		},
+		Driver: driver.Quota{
+			MaxProvisionedGB: int64(c.Int("driver-max-provisioned-gb")),
+			MaxVolumeGB:      int64(c.Int("driver-max-volume-gb")),
+		},
+	}
+	sd, err := driver.NewStorageDaemon(md.ContainerName, md.DriverName, md.Image, c.String("default-frontend"), quotas, template, client)
 	if err != nil {
 		logrus.Fatalf("Error creating storage daemon: %v", err)
 	}
 
+	sd.RegisterMetrics(metrics.Default)
+	if addr := c.GlobalString("metrics-listen"); addr != "" {
+		go func() {
+			err := metrics.ListenAndServe(addr)
+			logrus.Errorf("Metrics server exited with error: %v", err)
+		}()
+	}
+
+	if err := sd.Reconcile(c.Bool("reconcile-dry-run")); err != nil {
+		logrus.Errorf("Error reconciling mounts and local cache: %v", err)
+	}
+
+	if outdated, err := sd.OutdatedVolumes(); err != nil {
+		logrus.Errorf("Error looking for volumes created from older compose templates: %v", err)
+	} else if len(outdated) > 0 {
+		logrus.Warnf("Volumes %v weren't created from compose template version %v and can be upgraded.", outdated, template.Version)
+	}
+
+	token, err := util.ReadToken(c.GlobalString("driver-api-token"), c.GlobalString("driver-api-token-file"))
+	if err != nil {
+		logrus.Fatalf("Unable to read API token: %v", err)
+	}
+	apiConfig := driver.APIConfig{
+		Listen:      c.String("api-listen"),
+		Socket:      c.String("api-socket"),
+		TLSCert:     c.String("api-tls-cert"),
+		TLSKey:      c.String("api-tls-key"),
+		TLSClientCA: c.GlobalString("driver-api-ca"),
+		Token:       token,
+	}
+	ctx := util.ShutdownContext()
 	go func() {
-		err := sd.ListenAndServe()
+		err := sd.ListenAndServe(ctx, apiConfig)
 		logrus.Fatalf("API Server exited with error: %v.", err)
 	}()
 
-	d := NewRancherStorageDriver(sd)
+	go func() {
+		<-ctx.Done()
+		if !sd.WaitForOperations(time.Duration(c.Int("shutdown-grace-period")) * time.Second) {
+			logrus.Warnf("Volume operations still in progress at shutdown")
+		}
+		os.Exit(0)
+	}()
+
+	d := NewRancherStorageDriver(ctx, sd, time.Duration(c.Int("request-timeout"))*time.Second)
 	h := volume.NewHandler(d)
 	err = h.ServeUnix("root", util.ConstructSocketNameInContainer(md.DriverName))
 	if err != nil {
@@ -1,21 +1,40 @@
 package volumeplugin
 
 import (
+	"context"
 	"fmt"
+	"time"
+
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/rancher/docker-longhorn-driver/audit"
 	"github.com/rancher/docker-longhorn-driver/driver"
 	"github.com/rancher/docker-longhorn-driver/model"
 )
 
-func NewRancherStorageDriver(sd *driver.StorageDaemon) *RancherStorageDriver {
+func NewRancherStorageDriver(ctx context.Context, sd *driver.StorageDaemon, requestTimeout time.Duration) *RancherStorageDriver {
 	return &RancherStorageDriver{
-		daemonClient: sd,
+		daemonClient:   sd,
+		ctx:            ctx,
+		requestTimeout: requestTimeout,
 	}
 }
 
 type RancherStorageDriver struct {
 	daemonClient *driver.StorageDaemon
+	// Cancelled when the driver shuts down
+	ctx            context.Context
+	requestTimeout time.Duration
+}
+
+// requestContext returns the context of a Docker request, which is cancelled on shutdown or when the request timeout,
+// if any, expires
+func (d RancherStorageDriver) requestContext() (context.Context, context.CancelFunc) {
+	ctx := audit.WithCaller(d.ctx, "docker")
+	if d.requestTimeout > 0 {
+		return context.WithTimeout(ctx, d.requestTimeout)
+	}
+	return context.WithCancel(ctx)
 }
 
 func (d RancherStorageDriver) Create(request volume.Request) volume.Response {
@@ -26,7 +45,9 @@ func (d RancherStorageDriver) Create(request volume.Request) volume.Response {
 		Opts: request.Options,
 	}
 
-	v, err := d.daemonClient.Create(v)
+	ctx, cancel := d.requestContext()
+	defer cancel()
+	v, err := d.daemonClient.Create(ctx, v)
 	if err != nil {
 		return errorToResponse(err)
 	}
@@ -70,7 +91,9 @@ func (d RancherStorageDriver) Get(request volume.Request) volume.Response {
 
 func (d RancherStorageDriver) Remove(request volume.Request) volume.Response {
 	logrus.Infof("Docker Remove request: %v", request)
-	err := d.daemonClient.Delete(request.Name, false)
+	ctx, cancel := d.requestContext()
+	defer cancel()
+	err := d.daemonClient.Delete(ctx, request.Name, false)
 	if err != nil {
 		return errorToResponse(err)
 	}
@@ -80,7 +103,11 @@ func (d RancherStorageDriver) Remove(request volume.Request) volume.Response {
 
 func (d RancherStorageDriver) Mount(request volume.Request) volume.Response {
 	logrus.Infof("Docker Mount request: %v", request)
-	vol, err := d.daemonClient.Mount(request.Name)
+	// The plugin API version we're built against doesn't identify the requesting container, so mounts are counted
+	// without an ID
+	ctx, cancel := d.requestContext()
+	defer cancel()
+	vol, err := d.daemonClient.Mount(ctx, request.Name, "")
 	if err != nil {
 		return errorToResponse(err)
 	}
@@ -92,7 +119,9 @@ func (d RancherStorageDriver) Mount(request volume.Request) volume.Response {
 
 func (d RancherStorageDriver) Unmount(request volume.Request) volume.Response {
 	logrus.Infof("Docker Unmount request: %v", request)
-	err := d.daemonClient.Unmount(request.Name)
+	ctx, cancel := d.requestContext()
+	defer cancel()
+	err := d.daemonClient.Unmount(ctx, request.Name, "")
 	if err != nil {
 		return errorToResponse(err)
 	}
@@ -111,11 +140,6 @@ func (d RancherStorageDriver) Path(request volume.Request) volume.Response {
 		return errorToResponse(fmt.Errorf("No such volume %v", request.Name))
 	}
 
-	// TODO Keep an eye on how docker interacts with this call. Not sure of the proper behavior here.
-	if vol.Mountpoint == "moved" {
-		vol.Mountpoint = ""
-	}
-
 	return volume.Response{
 		Mountpoint: vol.Mountpoint,
 	}
@@ -135,6 +159,8 @@ func volToResponse(vol *model.Volume) volume.Response {
 	}
 }
 
+// The plugin API version we're built against has no volume status, so Docker can't be given a volume's state or usage.
+// They're reported by the driver's management API instead.
 func transformVolume(vol *model.Volume) *volume.Volume {
 	return &volume.Volume{
 		Name:       vol.Name,
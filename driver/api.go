@@ -0,0 +1,367 @@
+package driver
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+
+	"github.com/rancher/docker-longhorn-driver/audit"
+	"github.com/rancher/docker-longhorn-driver/util"
+)
+
+// api is the driver's JSON management API. Errors are returned as {"error": "..."} with 400 for invalid requests, 404
+// for unknown volumes and snapshots, 409 for operations the volume's current state doesn't allow and 500 otherwise.
+type api struct {
+	daemon *StorageDaemon
+}
+
+type createVolumeInput struct {
+	Name string            `json:"name"`
+	Opts map[string]string `json:"opts"`
+}
+
+type resizeInput struct {
+	Size string `json:"size"`
+}
+
+type snapshotInput struct {
+	Name string `json:"name"`
+}
+
+type backupInput struct {
+	// The backup-target-* options describing where to back up to
+	Opts map[string]string `json:"opts"`
+}
+
+type backupOutput struct {
+	URI string `json:"uri"`
+}
+
+type restoreInput struct {
+	Backup string `json:"backup"`
+	// The backup-target-* options describing where the backup is
+	Opts map[string]string `json:"opts"`
+}
+
+type collection struct {
+	Data interface{} `json:"data"`
+}
+
+type errorOutput struct {
+	Error string `json:"error"`
+}
+
+// APIConfig describes where and how the management API is served
+type APIConfig struct {
+	// TCP address to listen on. Empty to only serve on the socket.
+	Listen string
+	// Path of a unix socket to listen on. Empty to only serve over TCP.
+	Socket string
+	// Certificate and key to serve TCP requests over TLS with. Empty to serve plain HTTP.
+	TLSCert string
+	TLSKey  string
+	// If set, TLS clients must present a certificate signed by this CA
+	TLSClientCA string
+	// If set, requests must have an "Authorization: Bearer <token>" header
+	Token string
+}
+
+// ListenAndServe serves the management API as configured until one of the listeners fails. Requests' contexts are
+// derived from ctx, so that cancelling it on shutdown cancels the operations in progress.
+func (d *StorageDaemon) ListenAndServe(ctx context.Context, config APIConfig) error {
+	if config.Listen == "" && config.Socket == "" {
+		return fmt.Errorf("The API must listen on an address, a socket or both.")
+	}
+	// Anyone who can reach a TCP listener can delete volumes, so it must authenticate its clients
+	if config.Listen != "" && config.Token == "" && (config.TLSCert == "" || config.TLSClientCA == "") {
+		return fmt.Errorf("Serving the API on %v requires an API token or TLS with a client CA.", config.Listen)
+	}
+
+	var handler http.Handler = withAuditCaller(newRouter(d))
+	if config.Token != "" {
+		handler = requireToken(config.Token, handler)
+	} else {
+		logrus.Warnf("No API token configured. The management API only authenticates clients by their certificate or access to the socket.")
+	}
+
+	newServer := func(addr string) *http.Server {
+		return &http.Server{
+			Addr:        addr,
+			Handler:     handler,
+			BaseContext: func(net.Listener) context.Context { return ctx },
+		}
+	}
+
+	errs := make(chan error, 2)
+	if config.Socket != "" {
+		listener, err := listenUnix(config.Socket)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Serving management API on %v", config.Socket)
+		go func() {
+			errs <- newServer("").Serve(listener)
+		}()
+	}
+
+	if config.Listen != "" {
+		server := newServer(config.Listen)
+		if config.TLSCert != "" {
+			tlsConfig, err := util.NewTLSConfig(config.TLSCert, config.TLSKey, config.TLSClientCA)
+			if err != nil {
+				return err
+			}
+			if config.TLSClientCA != "" {
+				tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			server.TLSConfig = tlsConfig
+			logrus.Infof("Serving management API over TLS on %v", config.Listen)
+			go func() {
+				errs <- server.ListenAndServeTLS("", "")
+			}()
+		} else {
+			logrus.Infof("Serving management API on %v", config.Listen)
+			go func() {
+				errs <- server.ListenAndServe()
+			}()
+		}
+	}
+
+	return <-errs
+}
+
+// listenUnix listens on a socket that only root can connect to, replacing the socket left by a previous run
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Couldn't remove old socket %v. Error: %v", path, err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// withAuditCaller records the client, and the caller it made the request for if any, as the caller of the request's
+// operations in the audit log
+func withAuditCaller(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		caller := "http " + r.RemoteAddr
+		if c := r.Header.Get(audit.CallerHeader); c != "" {
+			caller = fmt.Sprintf("%v via %v", c, caller)
+		}
+		h.ServeHTTP(rw, r.WithContext(audit.WithCaller(r.Context(), caller)))
+	})
+}
+
+func requireToken(token string, h http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			logrus.Warnf("Rejected unauthenticated API request %v %v from %v", r.Method, r.URL, r.RemoteAddr)
+			writeJSON(rw, http.StatusUnauthorized, errorOutput{"Missing or invalid API token."})
+			return
+		}
+		h.ServeHTTP(rw, r)
+	})
+}
+
+func newRouter(d *StorageDaemon) *mux.Router {
+	a := &api{
+		daemon: d,
+	}
+	router := mux.NewRouter().StrictSlash(true)
+	router.Methods("GET").Path("/v1/volumes").HandlerFunc(a.listVolumes)
+	router.Methods("POST").Path("/v1/volumes").HandlerFunc(a.createVolume)
+	router.Methods("GET").Path("/v1/volumes/{name}").HandlerFunc(a.inspectVolume)
+	router.Methods("DELETE").Path("/v1/volumes/{name}").HandlerFunc(a.deleteVolume)
+	router.Methods("POST").Path("/v1/volumes/{name}").Queries("action", "resize").HandlerFunc(a.resizeVolume)
+	router.Methods("POST").Path("/v1/volumes/{name}").Queries("action", "upgrade").HandlerFunc(a.upgradeVolume)
+	router.Methods("POST").Path("/v1/volumes/{name}").Queries("action", "restore").HandlerFunc(a.restoreVolume)
+	router.Methods("GET").Path("/v1/volumes/{name}/snapshots").HandlerFunc(a.listSnapshots)
+	router.Methods("POST").Path("/v1/volumes/{name}/snapshots").HandlerFunc(a.createSnapshot)
+	router.Methods("DELETE").Path("/v1/volumes/{name}/snapshots/{snapshot}").HandlerFunc(a.deleteSnapshot)
+	router.Methods("POST").Path("/v1/volumes/{name}/snapshots/{snapshot}").Queries("action", "backup").HandlerFunc(a.backupSnapshot)
+	return router
+}
+
+func (a *api) listVolumes(rw http.ResponseWriter, r *http.Request) {
+	volumes, err := a.daemon.InspectAll()
+	if err != nil {
+		writeError(rw, "listing volumes", err)
+		return
+	}
+	writeJSON(rw, http.StatusOK, collection{volumes})
+}
+
+func (a *api) createVolume(rw http.ResponseWriter, r *http.Request) {
+	input := &createVolumeInput{}
+	if !readJSON(rw, r, input) {
+		return
+	}
+
+	info, err := a.daemon.CreateVolume(r.Context(), input.Name, input.Opts)
+	if err != nil {
+		writeError(rw, fmt.Sprintf("creating volume %v", input.Name), err)
+		return
+	}
+	writeJSON(rw, http.StatusCreated, info)
+}
+
+func (a *api) inspectVolume(rw http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	info, err := a.daemon.Inspect(name)
+	if err != nil {
+		writeError(rw, fmt.Sprintf("inspecting volume %v", name), err)
+		return
+	}
+	writeJSON(rw, http.StatusOK, info)
+}
+
+func (a *api) deleteVolume(rw http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := a.daemon.Delete(r.Context(), name, true); err != nil {
+		writeError(rw, fmt.Sprintf("deleting volume %v", name), err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) resizeVolume(rw http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	input := &resizeInput{}
+	if !readJSON(rw, r, input) {
+		return
+	}
+
+	if err := a.daemon.Resize(r.Context(), name, input.Size); err != nil {
+		writeError(rw, fmt.Sprintf("resizing volume %v", name), err)
+		return
+	}
+	a.inspectVolume(rw, r)
+}
+
+func (a *api) upgradeVolume(rw http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := a.daemon.Upgrade(r.Context(), name); err != nil {
+		writeError(rw, fmt.Sprintf("upgrading volume %v", name), err)
+		return
+	}
+	a.inspectVolume(rw, r)
+}
+
+func (a *api) restoreVolume(rw http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	input := &restoreInput{}
+	if !readJSON(rw, r, input) {
+		return
+	}
+
+	if err := a.daemon.Restore(r.Context(), name, input.Backup, input.Opts); err != nil {
+		writeError(rw, fmt.Sprintf("restoring backup %v into volume %v", input.Backup, name), err)
+		return
+	}
+	a.inspectVolume(rw, r)
+}
+
+func (a *api) listSnapshots(rw http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	snapshots, err := a.daemon.Snapshots(r.Context(), name)
+	if err != nil {
+		writeError(rw, fmt.Sprintf("listing snapshots of volume %v", name), err)
+		return
+	}
+	writeJSON(rw, http.StatusOK, collection{snapshots})
+}
+
+func (a *api) createSnapshot(rw http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	input := &snapshotInput{}
+	// The body is optional, in which case Longhorn names the snapshot
+	if !readOptionalJSON(rw, r, input) {
+		return
+	}
+
+	snapshot, err := a.daemon.CreateSnapshot(r.Context(), name, input.Name)
+	if err != nil {
+		writeError(rw, fmt.Sprintf("creating snapshot of volume %v", name), err)
+		return
+	}
+	writeJSON(rw, http.StatusCreated, snapshot)
+}
+
+func (a *api) deleteSnapshot(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, snapshot := vars["name"], vars["snapshot"]
+	if err := a.daemon.DeleteSnapshot(r.Context(), name, snapshot); err != nil {
+		writeError(rw, fmt.Sprintf("deleting snapshot %v of volume %v", snapshot, name), err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) backupSnapshot(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, snapshot := vars["name"], vars["snapshot"]
+	input := &backupInput{}
+	if !readJSON(rw, r, input) {
+		return
+	}
+
+	uri, err := a.daemon.Backup(r.Context(), name, snapshot, input.Opts)
+	if err != nil {
+		writeError(rw, fmt.Sprintf("backing up snapshot %v of volume %v", snapshot, name), err)
+		return
+	}
+	writeJSON(rw, http.StatusOK, backupOutput{uri})
+}
+
+// readJSON decodes the request body into obj. If it can't, it responds with 400 and returns false.
+func readJSON(rw http.ResponseWriter, r *http.Request, obj interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(obj); err != nil {
+		writeJSON(rw, http.StatusBadRequest, errorOutput{fmt.Sprintf("Couldn't parse request: %v", err)})
+		return false
+	}
+	return true
+}
+
+// readOptionalJSON is readJSON for requests whose body may be left out. The request's length can't be relied on to
+// tell, since it's unknown for chunked requests.
+func readOptionalJSON(rw http.ResponseWriter, r *http.Request, obj interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(obj); err != nil && err != io.EOF {
+		writeJSON(rw, http.StatusBadRequest, errorOutput{fmt.Sprintf("Couldn't parse request: %v", err)})
+		return false
+	}
+	return true
+}
+
+func writeError(rw http.ResponseWriter, operation string, err error) {
+	status := statusCode(err)
+	if status == http.StatusInternalServerError {
+		logrus.Errorf("Error %v: %v", operation, err)
+	} else {
+		logrus.Warnf("Rejected %v: %v", operation, err)
+	}
+	writeJSON(rw, status, errorOutput{err.Error()})
+}
+
+func writeJSON(rw http.ResponseWriter, status int, obj interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(obj); err != nil {
+		logrus.Errorf("Error writing response: %v", err)
+	}
+}
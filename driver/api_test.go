@@ -0,0 +1,141 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rancher/docker-longhorn-driver/longhorn"
+	"github.com/rancher/docker-longhorn-driver/model"
+)
+
+func TestStatusCode(t *testing.T) {
+	cases := map[error]int{
+		errNoSuchVolume("foo"):             http.StatusNotFound,
+		errMoved("foo", "mounted"):         http.StatusConflict,
+		errConflict("busy"):                http.StatusConflict,
+		errInvalid(fmt.Errorf("bad size")): http.StatusBadRequest,
+		errInvalid(errNoSuchVolume("foo")): http.StatusNotFound,
+		fmt.Errorf("metadata unreachable"): http.StatusInternalServerError,
+		longhorn.APIError{}:                http.StatusInternalServerError,
+	}
+	for err, expected := range cases {
+		if status := statusCode(err); status != expected {
+			t.Fatalf("Status of %q is %v. Expected %v", err, status, expected)
+		}
+	}
+}
+
+func TestAPIRejectsInvalidBody(t *testing.T) {
+	router := newRouter(&StorageDaemon{})
+	requests := []*http.Request{
+		httptest.NewRequest("POST", "/v1/volumes", strings.NewReader("{")),
+		httptest.NewRequest("POST", "/v1/volumes/foo?action=resize", strings.NewReader("10g")),
+		httptest.NewRequest("POST", "/v1/volumes/foo/snapshots/snap1?action=backup", strings.NewReader("")),
+	}
+	for _, req := range requests {
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+		if rw.Code != http.StatusBadRequest {
+			t.Fatalf("%v %v returned %v. Expected %v", req.Method, req.URL, rw.Code, http.StatusBadRequest)
+		}
+		output := errorOutput{}
+		if err := json.NewDecoder(rw.Body).Decode(&output); err != nil || output.Error == "" {
+			t.Fatalf("Expected JSON error from %v %v: %v", req.Method, req.URL, err)
+		}
+	}
+}
+
+func TestReadOptionalJSON(t *testing.T) {
+	for body, name := range map[string]string{"": "", `{"name": "snap1"}`: "snap1"} {
+		req := httptest.NewRequest("POST", "/v1/volumes/foo/snapshots", strings.NewReader(body))
+		// As for a chunked request
+		req.ContentLength = -1
+		input := &snapshotInput{}
+		rw := httptest.NewRecorder()
+		if !readOptionalJSON(rw, req, input) || input.Name != name {
+			t.Fatalf("Unexpected result for body %q: %v, %+v", body, rw.Code, input)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/v1/volumes/foo/snapshots", strings.NewReader("{"))
+	rw := httptest.NewRecorder()
+	if readOptionalJSON(rw, req, &snapshotInput{}) || rw.Code != http.StatusBadRequest {
+		t.Fatalf("Expected invalid body to be rejected, got %v", rw.Code)
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	handler := requireToken("secret", http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+
+	for header, expected := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer secret": http.StatusNoContent,
+	} {
+		req := httptest.NewRequest("DELETE", "/v1/volumes/foo", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		if rw.Code != expected {
+			t.Fatalf("Authorization %q returned %v. Expected %v", header, rw.Code, expected)
+		}
+	}
+}
+
+func TestListenRequiresAuthentication(t *testing.T) {
+	d := &StorageDaemon{}
+	for _, config := range []APIConfig{
+		{Listen: "127.0.0.1:0"},
+		{Listen: "127.0.0.1:0", TLSCert: "cert.pem", TLSKey: "key.pem"},
+		{Listen: "127.0.0.1:0", TLSClientCA: "ca.pem"},
+	} {
+		if err := d.ListenAndServe(context.Background(), config); err == nil {
+			t.Fatalf("Expected error for %+v", config)
+		}
+	}
+}
+
+func TestVolumeInUse(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+	d := &StorageDaemon{
+		store:   store,
+		rootDir: store.rootDir,
+	}
+
+	for _, name := range []string{"idle", "referenced", "fake"} {
+		if err := store.create(name, volumeConfig{Name: name, DontFormat: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.recordMount("referenced", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(fakeMountPoint(store.rootDir, "fake"), 0744); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]bool{"idle": false, "referenced": true, "fake": true} {
+		inUse, err := d.volumeInUse(&model.Volume{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inUse != expected {
+			t.Fatalf("Volume %v in use: %v. Expected %v", name, inUse, expected)
+		}
+	}
+	if inUse, _ := d.volumeInUse(&model.Volume{Name: "idle", Mountpoint: "/mnt"}); !inUse {
+		t.Fatal("Expected mounted volume to be in use")
+	}
+}
@@ -0,0 +1,129 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/docker/go-units"
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	optClass = "class"
+	// Key in the driver service's metadata that volume classes are defined under
+	volumeClassesMetadataKey = "VOLUME_CLASSES"
+)
+
+// volumeClass is a named set of volume options defined by the operator. For example:
+//
+//	VOLUME_CLASSES:
+//	  fast-db:
+//	    options:
+//	      size: 50g
+//	      fs-type: xfs
+//	      read-iops: 10000
+//	    overridable: [size]
+//	    limits:
+//	      size: 200g
+//
+// Options set by the class can only be changed by the user if they are listed in overridable. Limits cap the size,
+// IOPS and replica options, whether they come from the class or the user.
+type volumeClass struct {
+	Options     map[string]string `mapstructure:"options"`
+	Overridable []string          `mapstructure:"overridable"`
+	Limits      map[string]string `mapstructure:"limits"`
+}
+
+// volumeClasses reads the volume classes from the driver service's metadata
+func (d *StorageDaemon) volumeClasses() (map[string]volumeClass, error) {
+	svc, err := d.metadata.GetSelfService()
+	if err != nil {
+		return nil, err
+	}
+	return parseVolumeClasses(svc.Metadata[volumeClassesMetadataKey])
+}
+
+func parseVolumeClasses(raw interface{}) (map[string]volumeClass, error) {
+	classes := map[string]volumeClass{}
+	if raw == nil {
+		return classes, nil
+	}
+
+	// Metadata values are decoded from YAML, so numbers need to be converted to strings
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		WeaklyTypedInput: true,
+		Result:           &classes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := decoder.Decode(raw); err != nil {
+		return nil, fmt.Errorf("Couldn't parse %v. Error: %v", volumeClassesMetadataKey, err)
+	}
+	return classes, nil
+}
+
+// applyVolumeClass returns the options for a volume created with the class named in opts, which are the class's
+// options overridden by those given explicitly. If no class is named, opts are returned as is.
+func applyVolumeClass(classes map[string]volumeClass, opts map[string]string) (map[string]string, error) {
+	name := opts[optClass]
+	if name == "" {
+		return opts, nil
+	}
+
+	class, ok := classes[name]
+	if !ok {
+		available := []string{}
+		for n := range classes {
+			available = append(available, n)
+		}
+		sort.Strings(available)
+		return nil, fmt.Errorf("No such volume class %v. Available classes: %v", name, available)
+	}
+
+	result := map[string]string{}
+	for k, v := range class.Options {
+		result[k] = v
+	}
+
+	for k, v := range opts {
+		if _, setByClass := class.Options[k]; setByClass && v != class.Options[k] && !contains(class.Overridable, k) {
+			return nil, fmt.Errorf("Option %v is set to %v by volume class %v and can't be changed.", k, class.Options[k], name)
+		}
+		result[k] = v
+	}
+
+	for k, limit := range class.Limits {
+		if err := checkLimit(k, result[k], limit); err != nil {
+			return nil, fmt.Errorf("Volume class %v: %v", name, err)
+		}
+	}
+	return result, nil
+}
+
+func checkLimit(opt, value, limit string) error {
+	if value == "" {
+		return nil
+	}
+
+	parse := func(s string) (int64, error) {
+		return strconv.ParseInt(s, 10, 64)
+	}
+	if opt == optSize {
+		parse = units.RAMInBytes
+	}
+
+	v, err := parse(value)
+	if err != nil {
+		return fmt.Errorf("Can't parse %v %v. Error: %v", opt, value, err)
+	}
+	l, err := parse(limit)
+	if err != nil {
+		return fmt.Errorf("Can't parse limit %v for %v. Error: %v", limit, opt, err)
+	}
+	if v > l {
+		return fmt.Errorf("%v %v exceeds the limit of %v.", opt, value, limit)
+	}
+	return nil
+}
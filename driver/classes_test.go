@@ -0,0 +1,59 @@
+package driver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyVolumeClass(t *testing.T) {
+	classes, err := parseVolumeClasses(map[string]interface{}{
+		"fast-db": map[string]interface{}{
+			"options": map[string]interface{}{
+				"size":      "50g",
+				"fs-type":   "xfs",
+				"read-iops": 10000,
+			},
+			"overridable": []interface{}{"size"},
+			"limits": map[string]interface{}{
+				"size":      "200g",
+				"read-iops": 20000,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := applyVolumeClass(classes, map[string]string{"class": "fast-db", "mount-options": "noatime"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"class": "fast-db", "size": "50g", "fs-type": "xfs", "read-iops": "10000", "mount-options": "noatime"}
+	if !reflect.DeepEqual(opts, expected) {
+		t.Fatalf("Options are: %v. Expected %v", opts, expected)
+	}
+
+	opts, err = applyVolumeClass(classes, map[string]string{"class": "fast-db", "size": "100g", "fs-type": "xfs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts["size"] != "100g" {
+		t.Fatalf("Expected size to be overridden: %v", opts)
+	}
+
+	invalid := []map[string]string{
+		{"class": "slow"},
+		{"class": "fast-db", "fs-type": "ext4"},
+		{"class": "fast-db", "size": "500g"},
+	}
+	for _, o := range invalid {
+		if _, err := applyVolumeClass(classes, o); err == nil {
+			t.Fatalf("Expected error for %v", o)
+		}
+	}
+
+	opts = map[string]string{"size": "1g"}
+	if applied, err := applyVolumeClass(classes, opts); err != nil || !reflect.DeepEqual(applied, opts) {
+		t.Fatalf("Expected options without class to be unchanged: %v %v", applied, err)
+	}
+}
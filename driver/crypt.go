@@ -0,0 +1,136 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/rancher/docker-longhorn-driver/util"
+)
+
+const (
+	cryptsetupBin = "cryptsetup"
+	mapperDir     = "/dev/mapper"
+	mapperPrefix  = "longhorn-"
+	// Rancher secrets are made available to the driver container as files in this directory
+	secretsDir = "/run/secrets"
+)
+
+func validateEncryption(config volumeConfig) error {
+	if !config.Encrypted {
+		if config.EncryptionKeyFile != "" || config.EncryptionKeySecret != "" {
+			return fmt.Errorf("Options %v and %v require %v=true.", optEncryptionKeyFile, optEncryptionKeySecret, optEncrypted)
+		}
+		return nil
+	}
+
+	if config.DontFormat {
+		return fmt.Errorf("Option %v can't be combined with %v.", optEncrypted, optDontFormat)
+	}
+
+	if (config.EncryptionKeyFile == "") == (config.EncryptionKeySecret == "") {
+		return fmt.Errorf("Encrypted volumes require exactly one of the %v or %v options.", optEncryptionKeyFile, optEncryptionKeySecret)
+	}
+
+	keyFile, err := encryptionKeyFile(config)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(keyFile); err != nil {
+		return fmt.Errorf("Can't access encryption key %v. Error: %v", keyFile, err)
+	}
+
+	if _, err := exec.LookPath(cryptsetupBin); err != nil {
+		return fmt.Errorf("Encrypted volumes require %v, which isn't installed. Error: %v", cryptsetupBin, err)
+	}
+	return nil
+}
+
+func encryptionKeyFile(config volumeConfig) (string, error) {
+	if config.EncryptionKeyFile != "" {
+		return config.EncryptionKeyFile, nil
+	}
+	if config.EncryptionKeySecret != "" {
+		// The secret is a file name, it can't be used to read files outside of the secrets directory
+		secret := config.EncryptionKeySecret
+		if filepath.Base(secret) != secret || secret == "." || secret == ".." {
+			return "", fmt.Errorf("Invalid encryption key secret %v. It must be the name of a secret.", secret)
+		}
+		return filepath.Join(secretsDir, secret), nil
+	}
+	return "", fmt.Errorf("Volume %v is encrypted but has no encryption key configured.", config.Name)
+}
+
+func mapperName(volumeName string) string {
+	return mapperPrefix + volumeName
+}
+
+func mapperDevice(volumeName string) string {
+	return filepath.Join(mapperDir, mapperName(volumeName))
+}
+
+// fsDevice returns the device that holds the volume's filesystem. For encrypted volumes this is the dm-crypt mapping
+// on top of the Longhorn device and is only present while the volume is open.
+func fsDevice(volumeName string, config volumeConfig) string {
+	if config.Encrypted {
+		return mapperDevice(volumeName)
+	}
+	return getDevice(volumeName, config)
+}
+
+func luksFormat(dev string, config volumeConfig) error {
+	keyFile, err := encryptionKeyFile(config)
+	if err != nil {
+		return err
+	}
+
+	if _, err := util.Execute(cryptsetupBin, []string{"luksFormat", "--batch-mode", "--key-file", keyFile, dev}); err != nil {
+		return fmt.Errorf("Error encrypting %v: %v", dev, err)
+	}
+	return nil
+}
+
+// luksOpen maps the decrypted volume if it isn't already and returns the mapper device
+func luksOpen(volumeName string, config volumeConfig) (string, error) {
+	mapperDev := mapperDevice(volumeName)
+	if _, err := os.Stat(mapperDev); err == nil {
+		return mapperDev, nil
+	}
+
+	keyFile, err := encryptionKeyFile(config)
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"luksOpen", "--key-file", keyFile, getDevice(volumeName, config), mapperName(volumeName)}
+	if _, err := util.Execute(cryptsetupBin, args); err != nil {
+		return "", fmt.Errorf("Error opening encrypted volume %v: %v", volumeName, err)
+	}
+	return mapperDev, nil
+}
+
+// luksClose removes the volume's mapping. It is a no-op if the volume isn't open.
+func luksClose(volumeName string) error {
+	if _, err := os.Stat(mapperDevice(volumeName)); os.IsNotExist(err) {
+		return nil
+	}
+
+	if _, err := util.Execute(cryptsetupBin, []string{"luksClose", mapperName(volumeName)}); err != nil {
+		return fmt.Errorf("Error closing encrypted volume %v: %v", volumeName, err)
+	}
+	return nil
+}
+
+// luksResize grows an open mapping to fill the underlying Longhorn device
+func luksResize(volumeName string, config volumeConfig) error {
+	keyFile, err := encryptionKeyFile(config)
+	if err != nil {
+		return err
+	}
+
+	if _, err := util.Execute(cryptsetupBin, []string{"resize", "--key-file", keyFile, mapperName(volumeName)}); err != nil {
+		return fmt.Errorf("Error resizing encrypted volume %v: %v", volumeName, err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateEncryption(t *testing.T) {
+	key, err := ioutil.TempFile("", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(key.Name())
+	key.Close()
+
+	// A stand-in for cryptsetup, which must be installed to create encrypted volumes
+	bin, err := ioutil.TempDir("", "bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bin)
+	if err := ioutil.WriteFile(filepath.Join(bin, cryptsetupBin), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin)
+
+	valid := []volumeConfig{
+		{},
+		{Encrypted: true, EncryptionKeyFile: key.Name()},
+	}
+	for _, c := range valid {
+		if err := validateEncryption(c); err != nil {
+			t.Fatalf("Unexpected error for %+v: %v", c, err)
+		}
+	}
+
+	invalid := []volumeConfig{
+		{EncryptionKeyFile: key.Name()},
+		{Encrypted: true},
+		{Encrypted: true, EncryptionKeyFile: key.Name(), EncryptionKeySecret: "secret"},
+		{Encrypted: true, EncryptionKeyFile: key.Name(), DontFormat: true},
+		{Encrypted: true, EncryptionKeyFile: key.Name() + "-missing"},
+		{Encrypted: true, EncryptionKeySecret: "../../etc/shadow"},
+		{Encrypted: true, EncryptionKeySecret: "dir/secret"},
+		{Encrypted: true, EncryptionKeySecret: ".."},
+	}
+	for _, c := range invalid {
+		if err := validateEncryption(c); err == nil {
+			t.Fatalf("Expected error for %+v", c)
+		}
+	}
+
+	os.Setenv("PATH", "")
+	if err := validateEncryption(volumeConfig{Encrypted: true, EncryptionKeyFile: key.Name()}); err == nil {
+		t.Fatal("Expected error without cryptsetup")
+	}
+}
+
+func TestEncryptionKeyFile(t *testing.T) {
+	keyFile, err := encryptionKeyFile(volumeConfig{EncryptionKeySecret: "key"})
+	if err != nil || keyFile != "/run/secrets/key" {
+		t.Fatalf("Unexpected key file %v, %v", keyFile, err)
+	}
+	if _, err := encryptionKeyFile(volumeConfig{EncryptionKeySecret: "../../etc/shadow"}); err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestFsDevice(t *testing.T) {
+	if dev := fsDevice("foo", volumeConfig{}); dev != "/dev/longhorn/foo" {
+		t.Fatalf("Device is: %v. Expected /dev/longhorn/foo", dev)
+	}
+	if dev := fsDevice("foo", volumeConfig{Encrypted: true}); dev != "/dev/mapper/longhorn-foo" {
+		t.Fatalf("Device is: %v. Expected /dev/mapper/longhorn-foo", dev)
+	}
+}
@@ -1,74 +1,112 @@
 package driver
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/gorilla/mux"
-	"github.com/mitchellh/mapstructure"
 
 	md "github.com/rancher/go-rancher-metadata/metadata"
 	rancherClient "github.com/rancher/go-rancher/client"
 
+	"github.com/rancher/docker-longhorn-driver/audit"
+	"github.com/rancher/docker-longhorn-driver/longhorn"
+	"github.com/rancher/docker-longhorn-driver/metrics"
 	"github.com/rancher/docker-longhorn-driver/model"
 	"github.com/rancher/docker-longhorn-driver/util"
 )
 
 const (
-	root                = "/var/lib/rancher/longhorn"
-	mountsDir           = "mounts"
-	fakeMountsDir       = "fake-mounts"
-	localCacheDir       = "localcache"
-	mountBin            = "mount"
-	umountBin           = "umount"
-	rancherMetadataURL  = "http://rancher-metadata/2015-12-19"
-	defaultVolumeSize   = "10g"
-	optSize             = "size"
-	optReadIOPS         = "read-iops"
-	optWriteIOPS        = "write-iops"
-	optReplicaBaseImage = "base-image"
-	optDontFormat       = "dont-format"
+	root                   = "/var/lib/rancher/longhorn"
+	mountsDir              = "mounts"
+	fakeMountsDir          = "fake-mounts"
+	localCacheDir          = "localcache"
+	mountBin               = "mount"
+	umountBin              = "umount"
+	rancherMetadataURL     = "http://rancher-metadata/2015-12-19"
+	defaultVolumeSize      = "10g"
+	defaultReplicas        = 2
+	optSize                = "size"
+	optReadIOPS            = "read-iops"
+	optWriteIOPS           = "write-iops"
+	optReplicaBaseImage    = "base-image"
+	optDontFormat          = "dont-format"
+	optFsType              = "fs-type"
+	optMkfsOptions         = "mkfs-options"
+	optMountOptions        = "mount-options"
+	optEncrypted           = "encrypted"
+	optEncryptionKeyFile   = "encryption-key-file"
+	optEncryptionKeySecret = "encryption-key-secret"
+	optFsckPolicy          = "fsck-policy"
+	optFromSnapshot        = "from-snapshot"
+	optFromBackup          = "from-backup"
+	optReplicas            = "replicas"
+	optFrontend            = "frontend"
+	optBackupNFSServer     = "backup-target-nfs-server"
+	optBackupNFSShare      = "backup-target-nfs-share"
+	optBackupNFSOptions    = "backup-target-nfs-mount-options"
 )
 
 type VolumeManager interface {
 	List() ([]model.Volume, error)
 	Get(name string) (model.Volume, error)
-	Create(volume model.Volume) (model.Volume, error)
-	Delete(name string) error
-	Mount(name string) (model.Volume, error)
-	Unmount(name string) error
+	Create(ctx context.Context, volume model.Volume) (model.Volume, error)
+	Delete(ctx context.Context, name string) error
+	Mount(ctx context.Context, name, id string) (model.Volume, error)
+	Unmount(ctx context.Context, name, id string) error
 }
 
-func NewStorageDaemon(driverContainerName, driverName, volumeStackImage string, client *rancherClient.RancherClient) (*StorageDaemon, error) {
+func NewStorageDaemon(driverContainerName, driverName, volumeStackImage, defaultFrontend string, quotas Quotas, template *StackTemplate, client *rancherClient.RancherClient) (*StorageDaemon, error) {
+	if err := validateFrontend(defaultFrontend); err != nil {
+		return nil, err
+	}
+	if err := quotas.validate(); err != nil {
+		return nil, err
+	}
+
 	metadata := md.NewClient(rancherMetadataURL)
 
 	if err := os.MkdirAll(filepath.Join(root, localCacheDir), 0744); err != nil {
 		return nil, fmt.Errorf("Couldn't create localcache dir. Error: %v", err)
 	}
 
+	mounts := newMountTable()
+
 	volumeStore := &volumeStore{
-		mutex:    &sync.RWMutex{},
-		metadata: metadata,
-		rootDir:  root,
+		mutex:   &sync.RWMutex{},
+		index:   newVolumeIndex(metadata),
+		mounts:  mounts,
+		rootDir: root,
+	}
+
+	if err := volumeStore.migrateLocalCache(); err != nil {
+		return nil, fmt.Errorf("Couldn't migrate local cache. Error: %v", err)
+	}
+
+	auditLog, err := audit.Open(audit.DefaultPath)
+	if err != nil {
+		return nil, err
 	}
 
 	sd := &StorageDaemon{
+		locks:               newVolumeLocks(),
 		driverContainerName: driverContainerName,
 		driverName:          driverName,
 		client:              client,
 		metadata:            metadata,
 		store:               volumeStore,
+		mounts:              mounts,
 		volumeStackImage:    volumeStackImage,
+		template:            template,
+		defaultFrontend:     defaultFrontend,
+		auditLog:            auditLog,
+		quotas:              quotas,
 		rootDir:             root,
 	}
 
@@ -76,142 +114,238 @@ func NewStorageDaemon(driverContainerName, driverName, volumeStackImage string,
 }
 
 type StorageDaemon struct {
-	mutex               *sync.RWMutex
+	locks               *volumeLocks
 	client              *rancherClient.RancherClient
 	metadata            *md.Client
 	store               *volumeStore
+	mounts              *mountTable
 	driverContainerName string
 	driverName          string
 	hostUUID            string
 	volumeStackImage    string
+	template            *StackTemplate
+	defaultFrontend     string
+	auditLog            *audit.Log
+	quotas              Quotas
 	rootDir             string
 }
 
-func (d *StorageDaemon) ListenAndServe() error {
-	dh := &deleteHandler{
-		daemon: d,
-	}
-	router := mux.NewRouter().StrictSlash(true)
-	router.Methods("DELETE").Path("/v1/volumes/{name}").Handler(dh)
-	return http.ListenAndServe(":80", router)
+func (d *StorageDaemon) List() ([]*model.Volume, error) {
+	return d.store.list()
 }
 
-type deleteHandler struct {
-	daemon *StorageDaemon
+func (d *StorageDaemon) Get(name string) (*model.Volume, error) {
+	vol, _, _, err := d.store.get(name)
+	return vol, err
 }
 
-func (h *deleteHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	name := vars["name"]
-	err := h.daemon.Delete(name, true)
+// Create creates the volume's stack, or moves the controller of an existing stack to this host. If creating a new
+// stack fails or ctx is cancelled, the stack is deleted again.
+func (d *StorageDaemon) Create(ctx context.Context, volume *model.Volume) (_ *model.Volume, err error) {
+	defer metrics.Observe("driver", "create", time.Now(), &err)
+	defer d.auditLog.Record(ctx, "create", volume.Name, volume.Opts, time.Now(), &err)
+	logrus.Infof("Creating volume %v", volume)
+	unlock, err := d.locks.lock(ctx, volume.Name)
 	if err != nil {
-		logrus.Errorf("Error deleting volume %v: %v", name, err)
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte(err.Error()))
+		return nil, err
 	}
-}
+	defer unlock()
+	defer d.store.begin(volume.Name, model.StateCreating)()
 
-func (d *StorageDaemon) List() ([]*model.Volume, error) {
-	return d.store.list()
-}
+	if volume.Opts[optClass] != "" {
+		classes, err := d.volumeClasses()
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't get volume classes. Error: %v", err)
+		}
+		if volume.Opts, err = applyVolumeClass(classes, volume.Opts); err != nil {
+			return nil, errInvalid(err)
+		}
+		logrus.Infof("Volume %v options after applying class: %v", volume.Name, volume.Opts)
+	}
 
-func (d *StorageDaemon) Get(name string) (*model.Volume, error) {
-	vol, _, moved, err := d.store.get(name)
+	volConfig, err := newVolumeConfig(volume.Name, volume.Opts)
+	if err != nil {
+		return nil, errInvalid(err)
+	}
+	if volConfig.Frontend == "" {
+		volConfig.Frontend = d.defaultFrontend
+	}
 
-	if moved {
-		vol.Mountpoint = "moved"
-	} else {
+	if volConfig.FromSnapshot != "" {
+		if err := d.inheritFromSnapshotSource(&volConfig, volume.Opts); err != nil {
+			return nil, err
+		}
+	}
 
+	if err := validateEncryption(volConfig); err != nil {
+		return nil, errInvalid(err)
 	}
 
-	return vol, err
-}
+	if err := validateFsckInstalled(volConfig); err != nil {
+		return nil, errInvalid(err)
+	}
 
-func (d *StorageDaemon) Create(volume *model.Volume) (*model.Volume, error) {
-	logrus.Infof("Creating volume %v", volume)
-	d.store.create(volume.Name)
-
-	sizeStr := volume.Opts[optSize]
-	dontFormat, _ := strconv.ParseBool(volume.Opts[optDontFormat])
-	var size string
-	if sizeStr == "" {
-		if dontFormat {
-			sizeStr = "0b"
-		} else {
-			sizeStr = defaultVolumeSize
-		}
-		logrus.Infof("No size option provided. Using: %v", sizeStr)
+	if err := d.validateReplicas(volConfig); err != nil {
+		return nil, errInvalid(err)
 	}
-	size, sizeGB, err := util.ConvertSize(sizeStr)
-	if err != nil {
-		return nil, fmt.Errorf("Can't parse size %v. Error: %v", sizeStr, err)
+
+	if err := d.checkQuotas(quotaCreate, volConfig); err != nil {
+		return nil, err
 	}
 
-	volConfig := volumeConfig{
-		Name:             volume.Name,
-		Size:             size,
-		SizeGB:           sizeGB,
-		ReadIOPS:         volume.Opts[optReadIOPS],
-		WriteIOPS:        volume.Opts[optWriteIOPS],
-		ReplicaBaseImage: volume.Opts[optReplicaBaseImage],
-		DontFormat:       dontFormat,
+	if err := d.store.create(volume.Name, volConfig); err != nil {
+		return nil, err
 	}
-	stack := newStack(volume.Name, d.driverContainerName, d.driverName, d.volumeStackImage, volConfig, d.client)
 
-	if err := d.doCreateVolume(volume, stack); err != nil {
+	stack := newStack(volume.Name, d.driverContainerName, d.driverName, d.volumeStackImage, d.template, volConfig, d.client)
+
+	created, err := d.doCreateVolume(ctx, volume, stack)
+	if err != nil {
+		if created {
+			// If the driver is stopped before the rollback is done, it's finished by Reconcile on the next start
+			if err := d.store.recordRollbackPending(volume.Name); err != nil {
+				logrus.Warnf("Couldn't record pending rollback of volume %v: %v", volume.Name, err)
+			}
+			if rollbackErr := d.rollbackStack(stack); rollbackErr != nil {
+				logrus.Errorf("Error rolling back stack %v, it will be retried when the driver restarts: %v", stack.name, rollbackErr)
+				return nil, fmt.Errorf("Error creating Rancher stack for volume %v: %v.", volume.Name, err)
+			}
+		}
 		d.store.delete(volume.Name)
-		stack.delete()
 		return nil, fmt.Errorf("Error creating Rancher stack for volume %v: %v.", volume.Name, err)
 	}
+	if !created {
+		if err = d.store.create(volume.Name, d.existingVolumeConfig(volume.Name, volConfig)); err != nil {
+			return nil, err
+		}
+	}
 
 	logrus.Infof("Successfully created volume %v.", volume.Name)
 	return volume, nil
 }
 
-func (d *StorageDaemon) doCreateVolume(volume *model.Volume, stack *stack) error {
+// rollbackStack deletes a stack that was only partly created. The operation's context may have been cancelled, so
+// the rollback gets its own.
+func (d *StorageDaemon) rollbackStack(stack *stack) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+
+	logrus.Infof("Rolling back stack %v", stack.name)
+	if err := luksClose(stack.volumeConfig.Name); err != nil {
+		logrus.Warnf("Cannot close encrypted mapping for %v: %v", stack.volumeConfig.Name, err)
+	}
+	return stack.delete(ctx)
+}
+
+// doCreateVolume returns whether it created a new stack, which should be rolled back if it also returns an error
+func (d *StorageDaemon) doCreateVolume(ctx context.Context, volume *model.Volume, stack *stack) (bool, error) {
 	// Doing find just to see if we are creating versus using an existing stack
 	env, err := stack.find()
 	if err != nil {
-		return err
+		return false, err
 	}
+	created := env == nil
 
 	// Always run create because it also ensures that things are active
-	if _, err := stack.create(); err != nil {
+	if _, err := stack.create(ctx); err != nil {
+		return created, err
+	}
+
+	if created {
+		return true, d.initVolume(ctx, volume, stack)
+	}
+
+	if err := stack.moveController(ctx); err != nil {
+		logrus.Errorf("Failed to move controller to %v: %v", d.driverContainerName, err)
+		return false, err
+	}
+	return false, nil
+}
+
+// existingVolumeConfig returns the config of a volume whose stack already existed, which the options of the request
+// that moved it to this host don't describe. requested is returned if metadata doesn't have the volume yet.
+func (d *StorageDaemon) existingVolumeConfig(name string, requested volumeConfig) volumeConfig {
+	v, ok, err := d.store.index.get(name)
+	if err != nil {
+		logrus.Warnf("Couldn't get config of volume %v from metadata: %v", name, err)
+		return requested
+	}
+	if !ok {
+		logrus.Warnf("Volume %v isn't in metadata yet. Recording the config it was requested with.", name)
+		return requested
+	}
+	return v.config
+}
+
+// initVolume fills a newly created volume from a snapshot or backup, or encrypts and formats it
+func (d *StorageDaemon) initVolume(ctx context.Context, volume *model.Volume, stack *stack) error {
+	dev, err := waitForDevice(ctx, volume.Name, stack.volumeConfig)
+	if err != nil {
 		return err
 	}
 
-	// If env was nil then we created stack so we need to format
-	if env == nil {
-		dev := getDevice(volume.Name)
-		if err := waitForDevice(dev); err != nil {
+	if stack.volumeConfig.FromSnapshot != "" {
+		target, err := backupTargetFromOpts(volume.Opts)
+		if err != nil {
 			return err
 		}
+		// The clone gets the source's filesystem, so it must not be formatted
+		return populateFromSnapshot(ctx, stack.volumeConfig, target)
+	}
 
-		if stack.volumeConfig.DontFormat {
-			logrus.Infof("Skipping formatting for volume %v.", volume.Name)
-		} else {
-			logrus.Infof("Formatting volume %v - %v", volume.Name, dev)
-			cmd := exec.Command("mkfs.ext4", "-F", dev)
-			if err := cmd.Run(); err != nil {
-				return fmt.Errorf("Error running mkfs command: %v", err)
-			}
+	if stack.volumeConfig.FromBackup != "" {
+		target, err := backupTargetFromOpts(volume.Opts)
+		if err != nil {
+			return err
 		}
-	} else {
-		if err := stack.moveController(); err != nil {
-			logrus.Errorf("Failed to move controller to %v: %v", d.driverContainerName, err)
+		// The backup already contains a filesystem, so it must not be formatted
+		return restoreBackup(ctx, volume.Name, stack.volumeConfig.FromBackup, target)
+	}
+
+	if stack.volumeConfig.Encrypted {
+		logrus.Infof("Encrypting volume %v - %v", volume.Name, dev)
+		if err := luksFormat(dev, stack.volumeConfig); err != nil {
+			return err
+		}
+		if dev, err = luksOpen(volume.Name, stack.volumeConfig); err != nil {
 			return err
 		}
 	}
 
+	if stack.volumeConfig.DontFormat {
+		logrus.Infof("Skipping formatting for volume %v.", volume.Name)
+	} else {
+		logrus.Infof("Formatting volume %v - %v as %v", volume.Name, dev, stack.volumeConfig.fsType())
+		if err := format(dev, stack.volumeConfig); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (d *StorageDaemon) Delete(name string, removeStack bool) error {
-	// This delete is a simple operation that just removes the volume from the local cache
+func (d *StorageDaemon) Delete(ctx context.Context, name string, removeStack bool) (err error) {
+	defer metrics.Observe("driver", "delete", time.Now(), &err)
+	// Only deleting the stack destroys the volume's data, so it's audited separately from removing the volume from
+	// this host
+	operation := "remove"
+	if removeStack {
+		operation = "delete"
+	}
+	defer d.auditLog.Record(ctx, operation, name, nil, time.Now(), &err)
+	// Without removeStack, this delete is a simple operation that just removes the volume from the local cache
 	logrus.Infof("Deleting volume %v", name)
+	unlock, err := d.locks.lock(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	if removeStack {
-		stack := newStack(name, d.driverContainerName, d.driverName, d.volumeStackImage, volumeConfig{}, d.client)
-		if err := stack.delete(); err != nil {
+		defer d.store.begin(name, model.StateDeleting)()
+		if err := luksClose(name); err != nil {
+			logrus.Warnf("Cannot close encrypted mapping for %v: %v", name, err)
+		}
+		stack := newStack(name, d.driverContainerName, d.driverName, d.volumeStackImage, d.template, volumeConfig{}, d.client)
+		if err := stack.delete(ctx); err != nil {
 			return err
 		}
 	}
@@ -219,27 +353,162 @@ func (d *StorageDaemon) Delete(name string, removeStack bool) error {
 	return nil
 }
 
-func (d *StorageDaemon) Mount(name string) (*model.Volume, error) {
-	logrus.Infof("Mounting volume %v", name)
+// Resize grows a volume that resides on this host to the given size. The stack is upgraded so that its config and
+// disk size labels reflect the new size, then the Longhorn device and the filesystem on it are expanded.
+func (d *StorageDaemon) Resize(ctx context.Context, name, sizeStr string) (err error) {
+	defer metrics.Observe("driver", "resize", time.Now(), &err)
+	defer d.auditLog.Record(ctx, "resize", name, map[string]string{optSize: sizeStr}, time.Now(), &err)
+	logrus.Infof("Resizing volume %v to %v", name, sizeStr)
+	unlock, err := d.locks.lock(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	vol, config, moved, err := d.store.get(name)
 	if err != nil {
-		return nil, fmt.Errorf("Error getting volume: %v", err)
+		return fmt.Errorf("Error getting volume: %v", err)
 	}
 	if vol == nil {
-		return nil, fmt.Errorf("No such volume: %v", name)
+		return errNoSuchVolume(name)
+	}
+	if moved {
+		return errMoved(name, "resized")
+	}
+	if config.ReplicaBaseImage != "" {
+		return errConflict("Volume %v uses a base image and cannot be resized.", name)
+	}
+
+	size, sizeGB, err := util.ConvertSize(sizeStr)
+	if err != nil {
+		return errInvalid(fmt.Errorf("Can't parse size %v. Error: %v", sizeStr, err))
+	}
+	newSize, _ := strconv.ParseInt(size, 10, 64)
+	currentSize, _ := strconv.ParseInt(config.Size, 10, 64)
+	if newSize <= currentSize {
+		return errInvalid(fmt.Errorf("New size %v for volume %v must be larger than its current size of %v bytes.", sizeStr, name, currentSize))
+	}
+
+	config.Size = size
+	config.SizeGB = sizeGB
+	if err := d.checkQuotas(quotaResize, config); err != nil {
+		return err
+	}
+
+	stack := newStack(name, d.driverContainerName, d.driverName, d.volumeStackImage, d.template, config, d.client)
+	if err := stack.upgrade(ctx); err != nil {
+		return fmt.Errorf("Error upgrading stack for volume %v: %v", name, err)
+	}
+
+	if _, err := longhorn.NewVolumeClient(name).Resize(ctx, size); err != nil {
+		return fmt.Errorf("Error resizing Longhorn device for volume %v: %v", name, err)
+	}
+
+	if _, err := waitForDevice(ctx, name, config); err != nil {
+		return err
+	}
+
+	if config.DontFormat {
+		logrus.Infof("Skipping filesystem resize for volume %v because dont-format option was specified.", name)
+		return nil
+	}
+
+	mp := mountPoint(d.rootDir, name)
+	mounted, err := d.mounts.isMounted(mp)
+	if err != nil {
+		return err
+	}
+	if !mounted {
+		// Not all filesystems can be grown offline, so mount the volume just long enough to grow it
+		if _, err := d.volumeMount(vol, config); err != nil {
+			return err
+		}
+		defer d.volumeUnmount(vol, config)
+	}
+
+	if config.Encrypted {
+		if err := luksResize(name, config); err != nil {
+			return err
+		}
 	}
 
+	logrus.Infof("Resizing %v filesystem of volume %v", config.fsType(), name)
+	if err := growFilesystem(fsDevice(name, config), mp, config); err != nil {
+		return err
+	}
+
+	logrus.Infof("Successfully resized volume %v.", name)
+	return nil
+}
+
+// OutdatedVolumes returns the volumes on this host whose stacks were created from a different version of the compose
+// template than the one the driver is using
+func (d *StorageDaemon) OutdatedVolumes() ([]string, error) {
+	return d.store.index.outdated(d.template.Version)
+}
+
+// WaitForOperations waits up to timeout for volume operations in progress to finish, for example after their context
+// was cancelled on shutdown, and returns whether they did
+func (d *StorageDaemon) WaitForOperations(timeout time.Duration) bool {
+	return util.WaitTimeout(&d.locks.held, timeout)
+}
+
+// Upgrade regenerates the stack of a volume that resides on this host from the driver's current compose template
+func (d *StorageDaemon) Upgrade(ctx context.Context, name string) (err error) {
+	defer metrics.Observe("driver", "upgrade", time.Now(), &err)
+	defer d.auditLog.Record(ctx, "upgrade", name, nil, time.Now(), &err)
+	logrus.Infof("Upgrading stack of volume %v to template version %v", name, d.template.Version)
+	unlock, err := d.locks.lock(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	vol, config, moved, err := d.store.get(name)
+	if err != nil {
+		return fmt.Errorf("Error getting volume: %v", err)
+	}
+	if vol == nil {
+		return errNoSuchVolume(name)
+	}
 	if moved {
-		return nil, fmt.Errorf("Volume %v no longer reside on this host and cannot be mounted.", name)
+		return errMoved(name, "upgraded")
+	}
+
+	stack := newStack(name, d.driverContainerName, d.driverName, d.volumeStackImage, d.template, config, d.client)
+	if err := stack.upgrade(ctx); err != nil {
+		return fmt.Errorf("Error upgrading stack for volume %v: %v", name, err)
 	}
 
-	dev := getDevice(vol.Name)
+	_, err = waitForDevice(ctx, name, config)
+	return err
+}
+
+// Mount mounts the volume on this host and records a reference to it for the container with the given ID. The ID may
+// be empty if the caller doesn't know which container the mount is for.
+func (d *StorageDaemon) Mount(ctx context.Context, name, id string) (_ *model.Volume, err error) {
+	defer metrics.Observe("driver", "mount", time.Now(), &err)
+	defer d.auditLog.Record(ctx, "mount", name, nil, time.Now(), &err)
+	logrus.Infof("Mounting volume %v", name)
+	unlock, err := d.locks.lock(ctx, name)
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
-	if err := waitForDevice(dev); err != nil {
+	vol, config, moved, err := d.store.get(name)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting volume: %v", err)
+	}
+	if vol == nil {
+		return nil, errNoSuchVolume(name)
+	}
+
+	if moved {
+		return nil, errMoved(name, "mounted")
+	}
+
+	if _, err := waitForDevice(ctx, vol.Name, config); err != nil {
 		return nil, err
 	}
 
@@ -252,18 +521,33 @@ func (d *StorageDaemon) Mount(name string) (*model.Volume, error) {
 			return nil, err
 		}
 	} else {
-		mp, e = d.volumeMount(vol)
+		mp, e = d.volumeMount(vol, config)
 		if e != nil {
 			return nil, e
 		}
 	}
 
+	count, err := d.store.recordMount(name, id)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("Volume %v has %v mount reference(s).", name, count)
+
 	vol.Mountpoint = mp
 	return vol, nil
 }
 
-func (d *StorageDaemon) Unmount(name string) error {
+// Unmount drops the reference to the volume held by the container with the given ID and unmounts the volume once no
+// references remain
+func (d *StorageDaemon) Unmount(ctx context.Context, name, id string) (err error) {
+	defer metrics.Observe("driver", "unmount", time.Now(), &err)
+	defer d.auditLog.Record(ctx, "unmount", name, nil, time.Now(), &err)
 	logrus.Infof("Unmounting volume %v", name)
+	unlock, err := d.locks.lock(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	vol, config, moved, err := d.store.get(name)
 	if err != nil {
@@ -272,7 +556,22 @@ func (d *StorageDaemon) Unmount(name string) error {
 
 	// If volume doesn't exist or has been moved, just no-op and return successfully
 	if vol == nil || moved {
-		logrus.Infof("Umount called on a nonexistent or moved volume %v. No-op.", vol.Name)
+		logrus.Infof("Umount called on a nonexistent or moved volume %v. No-op.", name)
+		if vol != nil {
+			d.store.recordUnmount(name)
+		}
+		if err := luksClose(name); err != nil {
+			logrus.Warnf("Cannot close encrypted mapping for %v: %v", name, err)
+		}
+		return nil
+	}
+
+	count, err := d.store.releaseMount(name, id)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		logrus.Infof("Volume %v still has %v mount reference(s). Not unmounting.", name, count)
 		return nil
 	}
 
@@ -282,44 +581,75 @@ func (d *StorageDaemon) Unmount(name string) error {
 		if err := os.Remove(mp); err != nil {
 			logrus.Warnf("Cannot cleanup fake mount point directory %v due to %v.", mp, err)
 		}
-		return nil
-	}
-
-	mountPoint := mountPoint(d.rootDir, vol.Name)
-	if mountPoint == "" {
-		logrus.Infof("Umount called on umounted volume %v.", vol.Name)
-		return nil
+		return d.store.recordUnmount(name)
 	}
 
-	if _, err := callUmount([]string{mountPoint}); err != nil {
+	if err := d.volumeUnmount(vol, config); err != nil {
 		return err
 	}
-
-	if err := os.Remove(mountPoint); err != nil {
-		logrus.Warnf("Cannot cleanup mount point directory %v due to %v.", mountPoint, err)
-	}
-
-	return nil
+	return d.store.recordUnmount(name)
 }
 
-func (d *StorageDaemon) volumeMount(volume *model.Volume) (string, error) {
-	dev := getDevice(volume.Name)
+func (d *StorageDaemon) volumeMount(volume *model.Volume, config volumeConfig) (string, error) {
+	dev := getDevice(volume.Name, config)
+	if config.Encrypted {
+		var err error
+		if dev, err = luksOpen(volume.Name, config); err != nil {
+			return "", err
+		}
+	}
 
 	mountPoint := mountPoint(d.rootDir, volume.Name)
 	if err := os.MkdirAll(mountPoint, 0744); err != nil {
 		return "", err
 	}
 
-	if !isMounted(mountPoint) {
+	entry, err := d.mounts.get(mountPoint)
+	if err != nil {
+		return "", err
+	}
+
+	if entry == nil {
+		if err := checkFilesystem(dev, config); err != nil {
+			return "", err
+		}
+
 		logrus.Infof("Mounting volume %v to %v.", volume.Name, mountPoint)
-		_, err := callMount([]string{dev, mountPoint})
+		_, err := callMount(mountArgs(dev, mountPoint, config))
 		if err != nil {
 			return "", err
 		}
+	} else if !sameDevice(entry.Source, dev) {
+		return "", fmt.Errorf("Mount point %v for volume %v is already in use by %v.", mountPoint, volume.Name, entry.Source)
 	}
 	return mountPoint, nil
 }
 
+func (d *StorageDaemon) volumeUnmount(volume *model.Volume, config volumeConfig) error {
+	mountPoint := mountPoint(d.rootDir, volume.Name)
+	mounted, err := d.mounts.isMounted(mountPoint)
+	if err != nil {
+		return err
+	}
+
+	if mounted {
+		if _, err := callUmount([]string{mountPoint}); err != nil {
+			return err
+		}
+	} else {
+		logrus.Infof("Umount called on umounted volume %v.", volume.Name)
+	}
+
+	if err := os.Remove(mountPoint); err != nil {
+		logrus.Warnf("Cannot cleanup mount point directory %v due to %v.", mountPoint, err)
+	}
+
+	if config.Encrypted {
+		return luksClose(volume.Name)
+	}
+	return nil
+}
+
 func callUmount(cmdArgs []string) (string, error) {
 	output, err := util.Execute(umountBin, cmdArgs)
 	if err != nil {
@@ -336,20 +666,6 @@ func callMount(cmdArgs []string) (string, error) {
 	return output, nil
 }
 
-func isMounted(mountPoint string) bool {
-	output, err := callMount([]string{})
-	if err != nil {
-		return false
-	}
-	lines := strings.Split(output, "\n")
-	for _, line := range lines {
-		if strings.Contains(line, mountPoint) {
-			return true
-		}
-	}
-	return false
-}
-
 func mountPoint(rootDir, volumeName string) string {
 	return filepath.Join(rootDir, mountsDir, volumeName)
 }
@@ -358,46 +674,36 @@ func fakeMountPoint(rootDir, volumeName string) string {
 	return filepath.Join(rootDir, fakeMountsDir, volumeName)
 }
 
-func getDevice(volumeName string) string {
-	return filepath.Join(util.DevDir, volumeName)
-}
-
-func waitForDevice(dev string) error {
-	err := util.Backoff(5*time.Minute, fmt.Sprintf("Failed to find %s", dev), func() (bool, error) {
-		if _, err := os.Stat(dev); err == nil {
-			return true, nil
-		}
-		return false, nil
-	})
-	return err
-}
-
 type volumeStore struct {
-	mutex    *sync.RWMutex
-	metadata *md.Client
-	hostUUID string
-	rootDir  string
+	mutex   *sync.RWMutex
+	index   *volumeIndex
+	mounts  *mountTable
+	rootDir string
+
+	operationsMutex sync.Mutex
+	// The creating or deleting state of volumes with an operation in progress
+	operations map[string]string
 }
 
-func (s *volumeStore) create(name string) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	file := filepath.Join(s.rootDir, localCacheDir, name)
-	if err := ioutil.WriteFile(file, []byte{}, 0644); err != nil {
-		return fmt.Errorf("Couldn't write local cache record for %v. Error: %v", name, err)
+// begin reports the volume in the given state until the returned function is called
+func (s *volumeStore) begin(name, state string) func() {
+	s.operationsMutex.Lock()
+	defer s.operationsMutex.Unlock()
+	if s.operations == nil {
+		s.operations = map[string]string{}
+	}
+	s.operations[name] = state
+	return func() {
+		s.operationsMutex.Lock()
+		defer s.operationsMutex.Unlock()
+		delete(s.operations, name)
 	}
-	return nil
 }
 
-func (s *volumeStore) delete(name string) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	file := filepath.Join(s.rootDir, localCacheDir, name)
-	if err := os.Remove(file); err != nil {
-		return fmt.Errorf("Couldn't remove local cache record for %v. Error: %v", name, err)
-	}
-	return nil
+func (s *volumeStore) operation(name string) string {
+	s.operationsMutex.Lock()
+	defer s.operationsMutex.Unlock()
+	return s.operations[name]
 }
 
 // Return values are the volume, a boolean `moved` whose value is true if the volume has been moved to a different
@@ -405,13 +711,14 @@ func (s *volumeStore) delete(name string) error {
 func (s *volumeStore) get(name string) (*model.Volume, volumeConfig, bool, error) {
 	s.mutex.RLock()
 
-	volumes, err := s.getVolumesFromRancher()
+	volumes, err := s.index.all()
 	if err != nil {
 		s.mutex.RUnlock()
 		return nil, volumeConfig{}, false, fmt.Errorf("Couldn't obtain list of volumes from Rancher. Error: %v", err)
 	}
 
-	config, inRancher := volumes[name]
+	indexed, inRancher := volumes[name]
+	config := indexed.config
 
 	localCache, err := s.getVolumesInLocalCache()
 	if err != nil {
@@ -428,13 +735,19 @@ func (s *volumeStore) get(name string) (*model.Volume, volumeConfig, bool, error
 		return nil, volumeConfig{}, false, nil
 	} else if inRancher && !inLocalCache {
 		// Rancher says its on this host, but not in local cache, create entry
-		s.create(name)
+		s.create(name, config)
 	} else if !inRancher && inLocalCache {
 		// Rancher says its elsewhere, but it's in local cache. The volume has been moved.
 		moved = true
 	}
 
-	vol := s.constructVolume(name, moved)
+	if moved {
+		if r, err := s.record(name); err == nil && r != nil {
+			config = r.Config
+		}
+	}
+
+	vol := s.constructVolume(name, config, indexed, moved)
 
 	return vol, config, moved, nil
 }
@@ -443,7 +756,7 @@ func (s *volumeStore) list() ([]*model.Volume, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	inRancher, err := s.getVolumesFromRancher()
+	inRancher, err := s.index.all()
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't obtain list of volumes from Rancher. Error: %v", err)
 	}
@@ -455,16 +768,20 @@ func (s *volumeStore) list() ([]*model.Volume, error) {
 
 	v := make([]*model.Volume, len(inRancher))
 	idx := 0
-	for name := range inRancher {
-		vol := s.constructVolume(name, false)
+	for name, indexed := range inRancher {
+		vol := s.constructVolume(name, indexed.config, indexed, false)
 		v[idx] = vol
 		idx++
 	}
 
-	// These volumes are in our local cache but Rancher says they've moved, so we'll report them with a mountpoint of "moved"
+	// These volumes are in our local cache but Rancher says they've moved, so we'll report them as moved
 	for name := range inLocalCache {
 		if _, alsoInRancher := inRancher[name]; !alsoInRancher {
-			vol := s.constructVolume(name, true)
+			config := volumeConfig{}
+			if r, err := s.readRecord(name); err == nil && r != nil {
+				config = r.Config
+			}
+			vol := s.constructVolume(name, config, indexedVolume{}, true)
 			v = append(v, vol)
 		}
 	}
@@ -472,107 +789,90 @@ func (s *volumeStore) list() ([]*model.Volume, error) {
 	return v, nil
 }
 
-func (s *volumeStore) constructVolume(name string, moved bool) *model.Volume {
+// constructVolume reports a volume and its state. An operation in progress takes precedence over where the volume is,
+// which takes precedence over its health, and then over whether it's mounted or its device is attached.
+func (s *volumeStore) constructVolume(name string, config volumeConfig, indexed indexedVolume, moved bool) *model.Volume {
 	vol := &model.Volume{
-		Name: name,
+		Name:  name,
+		Opts:  config.opts(),
+		State: model.StateDetached,
 	}
 
 	if moved {
-		vol.Mountpoint = "moved"
+		vol.State = model.StateMoved
 	} else {
 		mp := mountPoint(s.rootDir, name)
-		if _, err := os.Stat(mp); err == nil {
+		if mounted, err := s.mounts.isMounted(mp); err != nil {
+			logrus.Warnf("Couldn't determine if volume %v is mounted: %v", name, err)
+		} else if mounted {
 			vol.Mountpoint = mp
+			vol.State = model.StateMounted
+		}
+		if vol.State == model.StateDetached && deviceAttached(name, config) {
+			vol.State = model.StateAttached
+		}
+		if indexed.degraded() {
+			vol.State = model.StateDegraded
 		}
 	}
 
+	if op := s.operation(name); op != "" {
+		vol.State = op
+	}
 	return vol
 }
 
-func (s *volumeStore) getVolumesInLocalCache() (map[string]bool, error) {
-	volumes := map[string]bool{}
-	files, err := ioutil.ReadDir(filepath.Join(s.rootDir, localCacheDir))
-	if err != nil {
-		return nil, err
-	}
+type volumeConfig struct {
+	Name                string `json:"name,omitempty" mapstructure:"name"`
+	Size                string `json:"size,omitempty" mapstructure:"size"`
+	SizeGB              string `json:"sizeGB,omitempty" mapstructure:"sizeGB"`
+	ReadIOPS            string `json:"readIops,omitempty" mapstructure:"readIops"`
+	WriteIOPS           string `json:"writeIops,omitempty" mapstructure:"writeIops"`
+	ReplicaBaseImage    string `json:"replicaBaseImage,omitempty" mapstructure:"replicaBaseImage"`
+	DontFormat          bool   `json:"dontFormat,omitempty" mapstructure:"dontFormat"`
+	FsType              string `json:"fsType,omitempty" mapstructure:"fsType"`
+	MkfsOptions         string `json:"mkfsOptions,omitempty" mapstructure:"mkfsOptions"`
+	MountOptions        string `json:"mountOptions,omitempty" mapstructure:"mountOptions"`
+	Encrypted           bool   `json:"encrypted,omitempty" mapstructure:"encrypted"`
+	EncryptionKeyFile   string `json:"encryptionKeyFile,omitempty" mapstructure:"encryptionKeyFile"`
+	EncryptionKeySecret string `json:"encryptionKeySecret,omitempty" mapstructure:"encryptionKeySecret"`
+	FsckPolicy          string `json:"fsckPolicy,omitempty" mapstructure:"fsckPolicy"`
+	FromSnapshot        string `json:"fromSnapshot,omitempty" mapstructure:"fromSnapshot"`
+	FromBackup          string `json:"fromBackup,omitempty" mapstructure:"fromBackup"`
+	Replicas            int    `json:"replicas,omitempty" mapstructure:"replicas"`
+	Class               string `json:"class,omitempty" mapstructure:"class"`
+	Frontend            string `json:"frontend,omitempty" mapstructure:"frontend"`
+}
 
-	for _, f := range files {
-		name := f.Name()
-		if _, ok := volumes[name]; !ok {
-			volumes[name] = false
-		}
+// Volumes created before fs-type was an option don't have it in their config and are always ext4
+func (v volumeConfig) fsType() string {
+	if v.FsType == "" {
+		return defaultFsType
 	}
-
-	return volumes, nil
+	return v.FsType
 }
 
-func (s *volumeStore) getVolumesFromRancher() (map[string]volumeConfig, error) {
-	// TODO We could cache the result for 5 or 10 seconds to reduce calls to metadata
-	stacks, err := s.metadata.GetStacks()
-	if err != nil {
-		return nil, err
+// ReplicaCount is the scale of the replica service. Volumes created before replicas was an option have two.
+func (v volumeConfig) ReplicaCount() int {
+	if v.Replicas == 0 {
+		return defaultReplicas
 	}
+	return v.Replicas
+}
 
-	if s.hostUUID == "" {
-		con, err := s.metadata.GetSelfContainer()
-		if err != nil {
-			return nil, err
-		}
-		s.hostUUID = con.HostUUID
-	}
-	volumes := map[string]volumeConfig{}
-	for _, stack := range stacks {
-		if strings.HasPrefix(stack.Name, util.VolumeStackPrefix) {
-			for _, service := range stack.Services {
-				if service.Name == "controller" {
-					for _, container := range service.Containers {
-						if lhmd := service.Metadata["volume"]; lhmd != nil && container.HostUUID == s.hostUUID {
-							if m, ok := lhmd.(map[string]interface{}); ok {
-								if name, ok := m["volume_name"].(string); ok && name != "" {
-									config, ok := m["volume_config"]
-									if !ok {
-										logrus.Warnf("Volume %v doesn't have config. Won't list as a volume.", name)
-										continue
-									}
-									m, ok := config.(map[string]interface{})
-
-									if !ok {
-										logrus.Warnf("Volume %v's config isn't a map. Won't list as a volume.", name)
-										continue
-									}
-
-									if len(m) == 0 {
-										logrus.Warnf("Volume %v's config is empty. Won't list as a volume.", name)
-										continue
-
-									}
-
-									var volumeConfig = volumeConfig{}
-									if err := mapstructure.Decode(m, &volumeConfig); err != nil {
-										logrus.Errorf("Error unmarshalling volume config for %v: %v. Won't list as a volume", name, err)
-										continue
-									}
-
-									volumes[name] = volumeConfig
-								}
-							}
-						}
-					}
-				}
-			}
-		}
+// FrontendName is the Longhorn frontend the controller exposes the volume through
+func (v volumeConfig) FrontendName() string {
+	if v.Frontend == "" {
+		return legacyFrontend
 	}
-	return volumes, nil
+	return v.Frontend
 }
 
-type volumeConfig struct {
-	Name             string `json:"name,omitempty" mapstructure:"name"`
-	Size             string `json:"size,omitempty" mapstructure:"size"`
-	SizeGB           string `json:"sizeGB,omitempty" mapstructure:"sizeGB"`
-	ReadIOPS         string `json:"readIops,omitempty" mapstructure:"readIops"`
-	WriteIOPS        string `json:"writeIops,omitempty" mapstructure:"writeIops"`
-	ReplicaBaseImage string `json:"replicaBaseImage,omitempty" mapstructure:"replicaBaseImage"`
-	DontFormat       bool   `json:"dontFormat,omitempty" mapstructure:"dontFormat"`
+// Quorum is the number of healthy replicas needed before unhealthy ones are recreated: half of the replicas, rounded
+// up. That's a majority for odd replica counts. For even counts half is enough, so that a volume with two replicas can
+// recover from losing one.
+func (v volumeConfig) Quorum() int {
+	return (v.ReplicaCount() + 1) / 2
 }
 
 func (v volumeConfig) JSON() string {
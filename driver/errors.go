@@ -0,0 +1,56 @@
+package driver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/rancher/docker-longhorn-driver/longhorn"
+)
+
+// requestError is an error caused by the request rather than by the driver failing, and carries the HTTP status the
+// API reports it with
+type requestError struct {
+	status int
+	msg    string
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+func errNoSuchVolume(name string) error {
+	return &requestError{http.StatusNotFound, fmt.Sprintf("No such volume: %v", name)}
+}
+
+func errMoved(name, operation string) error {
+	return &requestError{http.StatusConflict, fmt.Sprintf("Volume %v no longer reside on this host and cannot be %v.", name, operation)}
+}
+
+func errConflict(format string, args ...interface{}) error {
+	return &requestError{http.StatusConflict, fmt.Sprintf(format, args...)}
+}
+
+func errQuotaExceeded(format string, args ...interface{}) error {
+	return &requestError{http.StatusForbidden, fmt.Sprintf(format, args...)}
+}
+
+// errInvalid marks an error validating the options or input of a request
+func errInvalid(err error) error {
+	if _, ok := err.(*requestError); ok {
+		return err
+	}
+	return &requestError{http.StatusBadRequest, err.Error()}
+}
+
+// statusCode returns the HTTP status an error returned by the daemon should be reported with
+func statusCode(err error) int {
+	switch e := err.(type) {
+	case *requestError:
+		return e.status
+	case longhorn.APIError:
+		if e.StatusCode() == http.StatusNotFound {
+			return http.StatusNotFound
+		}
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,88 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/rancher/docker-longhorn-driver/util"
+)
+
+const (
+	frontendTCMU = "tcmu"
+	frontendTGT  = "tgt"
+	// Frontend of volumes created before the frontend was configurable
+	legacyFrontend = frontendTCMU
+
+	iscsiIQNPrefix  = "iqn.2014-09.com.rancher:"
+	iscsiByPathGlob = "/dev/disk/by-path/*-iscsi-%s-lun-*"
+)
+
+// The block device each Longhorn frontend exposes for a volume. The device may not exist yet, in which case "" is
+// returned.
+var frontendDevices = map[string]func(volumeName string) string{
+	// TCMU creates the device itself under /dev/longhorn
+	frontendTCMU: func(volumeName string) string {
+		return filepath.Join(util.DevDir, volumeName)
+	},
+	// tgt exports the volume as an iSCSI target that is logged into on the host, so the device is found through the
+	// udev by-path link of the target's LUN
+	frontendTGT: func(volumeName string) string {
+		matches, _ := filepath.Glob(fmt.Sprintf(iscsiByPathGlob, iscsiIQNPrefix+volumeName))
+		if len(matches) == 0 {
+			return ""
+		}
+		sort.Strings(matches)
+		return matches[0]
+	},
+}
+
+func validateFrontend(frontend string) error {
+	if _, ok := frontendDevices[frontend]; !ok {
+		supported := []string{}
+		for f := range frontendDevices {
+			supported = append(supported, f)
+		}
+		sort.Strings(supported)
+		return fmt.Errorf("Unsupported frontend %v. Supported frontends are: %v", frontend, supported)
+	}
+	return nil
+}
+
+// getDevice returns the Longhorn block device of the volume, or "" if the volume's frontend hasn't exposed it yet
+func getDevice(volumeName string, config volumeConfig) string {
+	device, ok := frontendDevices[config.FrontendName()]
+	if !ok {
+		return ""
+	}
+	return device(volumeName)
+}
+
+// deviceAttached returns whether the volume's frontend has exposed its block device on this host
+func deviceAttached(volumeName string, config volumeConfig) bool {
+	dev := getDevice(volumeName, config)
+	if dev == "" {
+		return false
+	}
+	_, err := os.Stat(dev)
+	return err == nil
+}
+
+// waitForDevice waits for the volume's frontend to expose its block device and returns the device
+func waitForDevice(ctx context.Context, volumeName string, config volumeConfig) (string, error) {
+	var dev string
+	err := util.Backoff(ctx, 5*time.Minute, fmt.Sprintf("Failed to find %v device for volume %v", config.FrontendName(), volumeName), func() (bool, error) {
+		dev = getDevice(volumeName, config)
+		if dev == "" {
+			return false, nil
+		}
+		if _, err := os.Stat(dev); err == nil {
+			return true, nil
+		}
+		return false, nil
+	})
+	return dev, err
+}
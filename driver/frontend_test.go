@@ -0,0 +1,35 @@
+package driver
+
+import (
+	"testing"
+)
+
+func TestValidateFrontend(t *testing.T) {
+	for _, f := range []string{"tcmu", "tgt"} {
+		if err := validateFrontend(f); err != nil {
+			t.Fatalf("Expected %v to be valid: %v", f, err)
+		}
+	}
+	for _, f := range []string{"", "iscsi", "TCMU"} {
+		if err := validateFrontend(f); err == nil {
+			t.Fatalf("Expected %q to be invalid", f)
+		}
+	}
+
+	if _, err := newVolumeConfig("foo", map[string]string{optFrontend: "nbd"}); err == nil {
+		t.Fatal("Expected error for unsupported frontend option")
+	}
+}
+
+func TestGetDevice(t *testing.T) {
+	if dev := getDevice("foo", volumeConfig{}); dev != "/dev/longhorn/foo" {
+		t.Fatalf("Unexpected device for legacy volume: %v", dev)
+	}
+	if dev := getDevice("foo", volumeConfig{Frontend: "tcmu"}); dev != "/dev/longhorn/foo" {
+		t.Fatalf("Unexpected tcmu device: %v", dev)
+	}
+	// The iSCSI device doesn't exist until the target has been logged into
+	if dev := getDevice("doesnotexist", volumeConfig{Frontend: "tgt"}); dev != "" {
+		t.Fatalf("Unexpected tgt device: %v", dev)
+	}
+}
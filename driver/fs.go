@@ -0,0 +1,226 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultFsType = "ext4"
+	fsckNone      = "none"
+	fsckCheck     = "check"
+	fsckRepair    = "repair"
+
+	// xfs_repair exits with 2 when the filesystem's log is dirty and must be replayed by mounting it first
+	xfsDirtyLogExitCode = 2
+)
+
+var mountOptionRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+(=[^,=\s]+)?$`)
+
+// Mount options that would change what the driver mounts or where, rather than how
+var disallowedMountOptions = map[string]bool{
+	"bind":    true,
+	"rbind":   true,
+	"move":    true,
+	"remount": true,
+	"loop":    true,
+}
+
+// The flag each mkfs variant uses to overwrite an existing filesystem signature
+var mkfsForceFlags = map[string]string{
+	"ext4":  "-F",
+	"xfs":   "-f",
+	"btrfs": "-f",
+}
+
+func mkfsCommand(fsType, mkfsOptions string) ([]string, error) {
+	force, ok := mkfsForceFlags[fsType]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported filesystem type %v. Supported types are ext4, xfs and btrfs.", fsType)
+	}
+
+	args := []string{force}
+	args = append(args, strings.Fields(mkfsOptions)...)
+	return append([]string{"mkfs." + fsType}, args...), nil
+}
+
+func growfsCommand(fsType, dev, mountPoint string) ([]string, error) {
+	switch fsType {
+	case "ext4":
+		return []string{"resize2fs", dev}, nil
+	case "xfs":
+		return []string{"xfs_growfs", mountPoint}, nil
+	case "btrfs":
+		return []string{"btrfs", "filesystem", "resize", "max", mountPoint}, nil
+	}
+	return nil, fmt.Errorf("Unsupported filesystem type %v. Supported types are ext4, xfs and btrfs.", fsType)
+}
+
+// fsckCommand returns the command that checks, or checks and repairs, a filesystem of the given type
+func fsckCommand(fsType, policy, dev string) ([]string, error) {
+	if policy != fsckCheck && policy != fsckRepair {
+		return nil, fmt.Errorf("Invalid fsck policy %v. Valid policies are %v, %v and %v.", policy, fsckNone, fsckCheck, fsckRepair)
+	}
+
+	repair := policy == fsckRepair
+	switch fsType {
+	case "ext4":
+		if repair {
+			return []string{"e2fsck", "-f", "-y", dev}, nil
+		}
+		return []string{"e2fsck", "-f", "-n", dev}, nil
+	case "xfs":
+		if repair {
+			return []string{"xfs_repair", dev}, nil
+		}
+		return []string{"xfs_repair", "-n", dev}, nil
+	case "btrfs":
+		if repair {
+			return []string{"btrfs", "check", "--repair", dev}, nil
+		}
+		return []string{"btrfs", "check", "--readonly", dev}, nil
+	}
+	return nil, fmt.Errorf("Unsupported filesystem type %v. Supported types are ext4, xfs and btrfs.", fsType)
+}
+
+func validateFsckPolicy(policy string) error {
+	if policy == "" || policy == fsckNone {
+		return nil
+	}
+	_, err := fsckCommand(defaultFsType, policy, "")
+	return err
+}
+
+// validateFsckInstalled makes sure that the checker the volume's fsck policy runs on every mount is installed
+func validateFsckInstalled(config volumeConfig) error {
+	if config.FsckPolicy == "" || config.FsckPolicy == fsckNone {
+		return nil
+	}
+	cmd, err := fsckCommand(config.fsType(), config.FsckPolicy, "")
+	if err != nil {
+		return err
+	}
+	if _, err := exec.LookPath(cmd[0]); err != nil {
+		return fmt.Errorf("Option %v=%v on %v requires %v, which isn't installed. Error: %v", optFsckPolicy, config.FsckPolicy, config.fsType(), cmd[0], err)
+	}
+	return nil
+}
+
+// e2fsck exits with 1 when it fixed errors, which is a success when repairing. Every other checker only succeeds with 0.
+func fsckSucceeded(fsType, policy string, exitCode int) bool {
+	return exitCode == 0 || (fsType == "ext4" && policy == fsckRepair && exitCode == 1)
+}
+
+// checkFilesystem runs fsck on the unmounted device according to the volume's fsck policy
+func checkFilesystem(dev string, config volumeConfig) error {
+	if config.FsckPolicy == "" || config.FsckPolicy == fsckNone {
+		return nil
+	}
+
+	cmd, err := fsckCommand(config.fsType(), config.FsckPolicy, dev)
+	if err != nil {
+		return err
+	}
+
+	if config.fsType() == "xfs" && config.FsckPolicy == fsckRepair {
+		if err := replayXfsLog(dev, config.Name); err != nil {
+			logrus.Warnf("Couldn't replay the XFS log of volume %v: %v", config.Name, err)
+		}
+	}
+
+	logrus.Infof("Running filesystem %v of volume %v: %v", config.FsckPolicy, config.Name, cmd)
+	output, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return fmt.Errorf("Error running %v on volume %v: %v. Output: %s", cmd[0], config.Name, err, output)
+	}
+	exitCode := exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+	if fsckSucceeded(config.fsType(), config.FsckPolicy, exitCode) {
+		logrus.Infof("Filesystem errors on volume %v were repaired. Output: %s", config.Name, output)
+		return nil
+	}
+	if config.fsType() == "xfs" && exitCode == xfsDirtyLogExitCode {
+		return fmt.Errorf("Volume %v has a dirty XFS log that couldn't be replayed by mounting it. Repairing it requires "+
+			"discarding the log with xfs_repair -L, which loses the latest changes, so it must be done manually. Output: %s", config.Name, output)
+	}
+	return fmt.Errorf("Filesystem %v of volume %v failed with exit code %v. Output: %s", config.FsckPolicy, config.Name, exitCode, output)
+}
+
+// replayXfsLog mounts and unmounts the device so that the log left by an unclean shutdown is replayed. xfs_repair
+// refuses to repair a filesystem with a dirty log.
+func replayXfsLog(dev, volumeName string) error {
+	dir, err := ioutil.TempDir("", "xfs-log-"+volumeName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dir)
+
+	logrus.Infof("Replaying XFS log of volume %v", volumeName)
+	if _, err := callMount([]string{"-t", "xfs", dev, dir}); err != nil {
+		return err
+	}
+	_, err = callUmount([]string{dir})
+	return err
+}
+
+// validateMountOptions checks that opts is a comma separated list of mount options in the form accepted by mount -o
+func validateMountOptions(opts string) error {
+	if opts == "" {
+		return nil
+	}
+
+	for _, opt := range strings.Split(opts, ",") {
+		if !mountOptionRegexp.MatchString(opt) {
+			return fmt.Errorf("Invalid mount option %q in %q.", opt, opts)
+		}
+		if disallowedMountOptions[strings.SplitN(opt, "=", 2)[0]] {
+			return fmt.Errorf("Mount option %q is not allowed.", opt)
+		}
+	}
+	return nil
+}
+
+func mountArgs(dev, mountPoint string, config volumeConfig) []string {
+	args := []string{"-t", config.fsType()}
+	if config.MountOptions != "" {
+		args = append(args, "-o", config.MountOptions)
+	}
+	return append(args, dev, mountPoint)
+}
+
+func format(dev string, config volumeConfig) error {
+	cmd, err := mkfsCommand(config.fsType(), config.MkfsOptions)
+	if err != nil {
+		return err
+	}
+
+	// Not using util.Execute because formatting a large device can take longer than its timeout
+	if output, err := exec.Command(cmd[0], append(cmd[1:], dev)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("Error running mkfs command: %v. Output: %s", err, output)
+	}
+	return nil
+}
+
+// growFilesystem expands the volume's filesystem to fill its device. The filesystem must be mounted at mountPoint.
+func growFilesystem(dev, mountPoint string, config volumeConfig) error {
+	cmd, err := growfsCommand(config.fsType(), dev, mountPoint)
+	if err != nil {
+		return err
+	}
+
+	if output, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("Error running %v: %v. Output: %s", cmd[0], err, output)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMkfsCommand(t *testing.T) {
+	cmd, err := mkfsCommand("xfs", "-m crc=1  -L data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"mkfs.xfs", "-f", "-m", "crc=1", "-L", "data"}
+	if !reflect.DeepEqual(cmd, expected) {
+		t.Fatalf("Command is: %v. Expected %v", cmd, expected)
+	}
+
+	cmd, err = mkfsCommand("ext4", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"mkfs.ext4", "-F"}
+	if !reflect.DeepEqual(cmd, expected) {
+		t.Fatalf("Command is: %v. Expected %v", cmd, expected)
+	}
+
+	if _, err := mkfsCommand("ntfs", ""); err == nil {
+		t.Fatal("Expected error for unsupported filesystem type")
+	}
+}
+
+func TestFsTypeDefault(t *testing.T) {
+	if fsType := (volumeConfig{}).fsType(); fsType != "ext4" {
+		t.Fatalf("Filesystem type is: %v. Expected ext4", fsType)
+	}
+}
+
+func TestGrowfsCommand(t *testing.T) {
+	cmd, err := growfsCommand("ext4", "/dev/longhorn/foo", "/mnt/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"resize2fs", "/dev/longhorn/foo"}; !reflect.DeepEqual(cmd, expected) {
+		t.Fatalf("Command is: %v. Expected %v", cmd, expected)
+	}
+
+	cmd, err = growfsCommand("xfs", "/dev/longhorn/foo", "/mnt/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"xfs_growfs", "/mnt/foo"}; !reflect.DeepEqual(cmd, expected) {
+		t.Fatalf("Command is: %v. Expected %v", cmd, expected)
+	}
+}
+
+func TestValidateMountOptions(t *testing.T) {
+	for _, opts := range []string{"", "noatime", "noatime,discard,data=writeback", "ro,nobarrier"} {
+		if err := validateMountOptions(opts); err != nil {
+			t.Fatalf("Unexpected error for %q: %v", opts, err)
+		}
+	}
+
+	for _, opts := range []string{",", "noatime,", "noatime discard", "data=", "bind", "noatime,remount"} {
+		if err := validateMountOptions(opts); err == nil {
+			t.Fatalf("Expected error for %q", opts)
+		}
+	}
+}
+
+func TestMountArgs(t *testing.T) {
+	config := volumeConfig{FsType: "xfs", MountOptions: "noatime,discard"}
+	args := mountArgs("/dev/longhorn/foo", "/mnt/foo", config)
+	expected := []string{"-t", "xfs", "-o", "noatime,discard", "/dev/longhorn/foo", "/mnt/foo"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Args are: %v. Expected %v", args, expected)
+	}
+
+	args = mountArgs("/dev/longhorn/foo", "/mnt/foo", volumeConfig{})
+	expected = []string{"-t", "ext4", "/dev/longhorn/foo", "/mnt/foo"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Args are: %v. Expected %v", args, expected)
+	}
+}
+
+func TestFsckCommand(t *testing.T) {
+	cmd, err := fsckCommand("ext4", "check", "/dev/longhorn/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"e2fsck", "-f", "-n", "/dev/longhorn/foo"}; !reflect.DeepEqual(cmd, expected) {
+		t.Fatalf("Command is: %v. Expected %v", cmd, expected)
+	}
+
+	cmd, err = fsckCommand("xfs", "repair", "/dev/longhorn/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"xfs_repair", "/dev/longhorn/foo"}; !reflect.DeepEqual(cmd, expected) {
+		t.Fatalf("Command is: %v. Expected %v", cmd, expected)
+	}
+
+	for _, policy := range []string{"", "none", "check", "repair"} {
+		if err := validateFsckPolicy(policy); err != nil {
+			t.Fatalf("Unexpected error for policy %q: %v", policy, err)
+		}
+	}
+	if err := validateFsckPolicy("fix"); err == nil {
+		t.Fatal("Expected error for invalid policy")
+	}
+
+	if !fsckSucceeded("ext4", "repair", 1) || fsckSucceeded("ext4", "check", 1) || fsckSucceeded("xfs", "repair", 1) {
+		t.Fatal("Unexpected fsck exit code handling")
+	}
+}
+
+func TestValidateFsckInstalled(t *testing.T) {
+	// Only a stand-in for xfs_repair is on the path
+	bin, err := ioutil.TempDir("", "bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bin)
+	if err := ioutil.WriteFile(filepath.Join(bin, "xfs_repair"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin)
+
+	for _, config := range []volumeConfig{
+		{FsType: "btrfs"},
+		{FsType: "btrfs", FsckPolicy: fsckNone},
+		{FsType: "xfs", FsckPolicy: fsckRepair},
+	} {
+		if err := validateFsckInstalled(config); err != nil {
+			t.Fatalf("Unexpected error for %+v: %v", config, err)
+		}
+	}
+	if err := validateFsckInstalled(volumeConfig{FsType: "btrfs", FsckPolicy: fsckCheck}); err == nil {
+		t.Fatal("Expected error without btrfs")
+	}
+}
@@ -0,0 +1,258 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mitchellh/mapstructure"
+
+	md "github.com/rancher/go-rancher-metadata/metadata"
+
+	"github.com/rancher/docker-longhorn-driver/util"
+)
+
+// indexedVolume is a Longhorn volume as described by Rancher metadata
+type indexedVolume struct {
+	config volumeConfig
+	// The version of the compose template the volume's stack was created or last upgraded from. Empty for stacks
+	// created before templates were versioned.
+	templateVersion string
+	// The hosts of the controller's containers. There is normally only one, but there can briefly be two while the
+	// controller is being moved.
+	hostUUIDs []string
+	// The number of replica containers whose health check passes
+	healthyReplicas int
+}
+
+func (v indexedVolume) onHost(hostUUID string) bool {
+	return contains(v.hostUUIDs, hostUUID)
+}
+
+func (v indexedVolume) degraded() bool {
+	return v.healthyReplicas < v.config.ReplicaCount()
+}
+
+// volumeIndex is an in-memory view of the Longhorn volumes in Rancher metadata. It is only rebuilt when the metadata
+// version changes and keeps serving the last good view if metadata can't be reached.
+type volumeIndex struct {
+	mutex    *sync.RWMutex
+	metadata *md.Client
+	hostUUID string
+	version  string
+	volumes  map[string]indexedVolume
+}
+
+func newVolumeIndex(metadata *md.Client) *volumeIndex {
+	return &volumeIndex{
+		mutex:    &sync.RWMutex{},
+		metadata: metadata,
+	}
+}
+
+// all returns every volume whose controller is on this host, keyed by volume name
+func (i *volumeIndex) all() (map[string]indexedVolume, error) {
+	if err := i.refresh(); err != nil {
+		return nil, err
+	}
+
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	volumes := map[string]indexedVolume{}
+	for name, v := range i.volumes {
+		if v.onHost(i.hostUUID) {
+			volumes[name] = v
+		}
+	}
+	return volumes, nil
+}
+
+// get returns the named volume wherever its controller is running
+func (i *volumeIndex) get(name string) (indexedVolume, bool, error) {
+	if err := i.refresh(); err != nil {
+		return indexedVolume{}, false, err
+	}
+
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	v, ok := i.volumes[name]
+	return v, ok, nil
+}
+
+// list returns every volume, wherever its controller is running, and the UUID of this host
+func (i *volumeIndex) list() (map[string]indexedVolume, string, error) {
+	if err := i.refresh(); err != nil {
+		return nil, "", err
+	}
+
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	volumes := map[string]indexedVolume{}
+	for name, v := range i.volumes {
+		volumes[name] = v
+	}
+	return volumes, i.hostUUID, nil
+}
+
+// outdated returns the names of the volumes on this host whose stacks weren't created from the given template version
+func (i *volumeIndex) outdated(version string) ([]string, error) {
+	if err := i.refresh(); err != nil {
+		return nil, err
+	}
+
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	names := []string{}
+	for name, v := range i.volumes {
+		if v.onHost(i.hostUUID) && v.templateVersion != version {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// host returns the UUID of the host the driver is running on. It is empty until the index has been built.
+func (i *volumeIndex) host() string {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.hostUUID
+}
+
+func (i *volumeIndex) refresh() error {
+	version, err := i.metadata.GetVersion()
+	if err != nil {
+		return i.staleOrError(err)
+	}
+
+	i.mutex.RLock()
+	current := i.version
+	i.mutex.RUnlock()
+	if version == current {
+		return nil
+	}
+
+	if err := i.rebuild(version); err != nil {
+		return i.staleOrError(err)
+	}
+	return nil
+}
+
+func (i *volumeIndex) staleOrError(err error) error {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	if i.volumes == nil {
+		return err
+	}
+	logrus.Warnf("Couldn't refresh volumes from metadata, using volumes from version %v. Error: %v", i.version, err)
+	return nil
+}
+
+func (i *volumeIndex) rebuild(version string) error {
+	if i.hostUUID == "" {
+		con, err := i.metadata.GetSelfContainer()
+		if err != nil {
+			return err
+		}
+		i.mutex.Lock()
+		i.hostUUID = con.HostUUID
+		i.mutex.Unlock()
+	}
+
+	stacks, err := i.metadata.GetStacks()
+	if err != nil {
+		return err
+	}
+
+	volumes := volumesFromStacks(stacks)
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	logrus.Debugf("Rebuilt volume index with %v volumes for metadata version %v", len(volumes), version)
+	i.volumes = volumes
+	i.version = version
+	return nil
+}
+
+func volumesFromStacks(stacks []md.Stack) map[string]indexedVolume {
+	volumes := map[string]indexedVolume{}
+	for _, stack := range stacks {
+		if !strings.HasPrefix(stack.Name, util.VolumeStackPrefix) {
+			continue
+		}
+		healthyReplicas := 0
+		for _, service := range stack.Services {
+			if service.Name != "replica" {
+				continue
+			}
+			for _, container := range service.Containers {
+				if container.HealthState == "healthy" {
+					healthyReplicas++
+				}
+			}
+		}
+		for _, service := range stack.Services {
+			if service.Name != "controller" {
+				continue
+			}
+
+			name, config, ok := volumeConfigFromMetadata(service.Metadata)
+			if !ok {
+				continue
+			}
+
+			v := indexedVolume{
+				config:          config,
+				healthyReplicas: healthyReplicas,
+			}
+			if m, ok := service.Metadata["volume"].(map[string]interface{}); ok && m["template_version"] != nil {
+				v.templateVersion = fmt.Sprintf("%v", m["template_version"])
+			}
+			for _, container := range service.Containers {
+				v.hostUUIDs = append(v.hostUUIDs, container.HostUUID)
+			}
+			volumes[name] = v
+		}
+	}
+	return volumes
+}
+
+func volumeConfigFromMetadata(metadata map[string]interface{}) (string, volumeConfig, bool) {
+	m, ok := metadata["volume"].(map[string]interface{})
+	if !ok {
+		return "", volumeConfig{}, false
+	}
+
+	name, ok := m["volume_name"].(string)
+	if !ok || name == "" {
+		return "", volumeConfig{}, false
+	}
+
+	config, ok := m["volume_config"]
+	if !ok {
+		logrus.Warnf("Volume %v doesn't have config. Won't list as a volume.", name)
+		return "", volumeConfig{}, false
+	}
+
+	c, ok := config.(map[string]interface{})
+	if !ok {
+		logrus.Warnf("Volume %v's config isn't a map. Won't list as a volume.", name)
+		return "", volumeConfig{}, false
+	}
+
+	if len(c) == 0 {
+		logrus.Warnf("Volume %v's config is empty. Won't list as a volume.", name)
+		return "", volumeConfig{}, false
+	}
+
+	var volumeConfig = volumeConfig{}
+	if err := mapstructure.Decode(c, &volumeConfig); err != nil {
+		logrus.Errorf("Error unmarshalling volume config for %v: %v. Won't list as a volume", name, err)
+		return "", volumeConfig, false
+	}
+
+	return name, volumeConfig, true
+}
@@ -0,0 +1,96 @@
+package driver
+
+import (
+	"testing"
+
+	md "github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestVolumesFromStacks(t *testing.T) {
+	controller := func(name string, config map[string]interface{}, hosts ...string) md.Service {
+		svc := md.Service{
+			Name: "controller",
+			Metadata: map[string]interface{}{
+				"volume": map[string]interface{}{
+					"volume_name":   name,
+					"volume_config": config,
+				},
+			},
+		}
+		for _, h := range hosts {
+			svc.Containers = append(svc.Containers, md.Container{HostUUID: h})
+		}
+		return svc
+	}
+
+	stacks := []md.Stack{
+		{Name: "volume-foo", Services: []md.Service{controller("foo", map[string]interface{}{"name": "foo", "sizeGB": "10"}, "host1")}},
+		{Name: "volume-bar", Services: []md.Service{controller("bar", map[string]interface{}{"name": "bar"}, "host1", "host2")}},
+		{Name: "volume-empty", Services: []md.Service{controller("empty", map[string]interface{}{}, "host1")}},
+		{Name: "other", Services: []md.Service{controller("other", map[string]interface{}{"name": "other"}, "host1")}},
+	}
+
+	volumes := volumesFromStacks(stacks)
+	if len(volumes) != 2 {
+		t.Fatalf("Found %v volumes. Expected 2: %v", len(volumes), volumes)
+	}
+
+	foo := volumes["foo"]
+	if foo.config.SizeGB != "10" || !foo.onHost("host1") || foo.onHost("host2") {
+		t.Fatalf("Unexpected volume foo: %+v", foo)
+	}
+
+	if bar := volumes["bar"]; !bar.onHost("host1") || !bar.onHost("host2") {
+		t.Fatalf("Unexpected volume bar: %+v", bar)
+	}
+}
+
+func TestReplicasFromMetadata(t *testing.T) {
+	stacks := []md.Stack{{
+		Name: "volume-foo",
+		Services: []md.Service{{
+			Name: "controller",
+			Metadata: map[string]interface{}{
+				"volume": map[string]interface{}{
+					"volume_name": "foo",
+					// Numbers in metadata are decoded from JSON as floats
+					"volume_config": map[string]interface{}{"name": "foo", "replicas": float64(3)},
+				},
+			},
+		}},
+	}}
+
+	foo := volumesFromStacks(stacks)["foo"]
+	if foo.config.ReplicaCount() != 3 {
+		t.Fatalf("Unexpected replica count %v", foo.config.ReplicaCount())
+	}
+}
+
+func TestDegradedFromMetadata(t *testing.T) {
+	replicas := func(health ...string) md.Service {
+		svc := md.Service{Name: "replica"}
+		for _, h := range health {
+			svc.Containers = append(svc.Containers, md.Container{HealthState: h})
+		}
+		return svc
+	}
+	controller := md.Service{
+		Name: "controller",
+		Metadata: map[string]interface{}{
+			"volume": map[string]interface{}{
+				"volume_name":   "foo",
+				"volume_config": map[string]interface{}{"name": "foo"},
+			},
+		},
+	}
+
+	foo := volumesFromStacks([]md.Stack{{Name: "volume-foo", Services: []md.Service{replicas("healthy", "healthy"), controller}}})["foo"]
+	if foo.healthyReplicas != 2 || foo.degraded() {
+		t.Fatalf("Expected healthy volume, got %+v", foo)
+	}
+
+	foo = volumesFromStacks([]md.Stack{{Name: "volume-foo", Services: []md.Service{controller, replicas("healthy", "unhealthy")}}})["foo"]
+	if foo.healthyReplicas != 1 || !foo.degraded() {
+		t.Fatalf("Expected degraded volume, got %+v", foo)
+	}
+}
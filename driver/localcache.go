@@ -0,0 +1,322 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	localRecordVersion = 1
+	// Mount references were kept in this dir, one JSON file per volume, before they were part of the records
+	mountRefsDir = "mountrefs"
+)
+
+// localRecord is what this host knows about a volume that has been created or used on it. Records are stored as JSON
+// in the local cache dir, one file per volume.
+type localRecord struct {
+	Version     int            `json:"version"`
+	Name        string         `json:"name"`
+	HostUUID    string         `json:"hostUUID,omitempty"`
+	Config      volumeConfig   `json:"config"`
+	Created     time.Time      `json:"created"`
+	LastMounted time.Time      `json:"lastMounted"`
+	Mounted     bool           `json:"mounted"`
+	MountRefs   mountRefRecord `json:"mountRefs"`
+	// Set while the stack of a failed create is being deleted, so that the rollback can be finished on the next start
+	RollbackPending bool `json:"rollbackPending,omitempty"`
+}
+
+func (s *volumeStore) create(name string, config volumeConfig) error {
+	return s.update(name, func(r *localRecord) {
+		r.Config = config
+	})
+}
+
+func (s *volumeStore) delete(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.Remove(s.recordFile(name)); err != nil {
+		return fmt.Errorf("Couldn't remove local cache record for %v. Error: %v", name, err)
+	}
+	return nil
+}
+
+// record returns the volume's local cache record or nil if there isn't one
+func (s *volumeStore) record(name string) (*localRecord, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.readRecord(name)
+}
+
+// update applies f to the volume's local cache record and saves it, creating the record if it doesn't exist
+func (s *volumeStore) update(name string, f func(r *localRecord)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	r, err := s.readRecord(name)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		r = &localRecord{
+			Name:    name,
+			Created: time.Now().UTC(),
+		}
+	}
+
+	f(r)
+	r.Version = localRecordVersion
+	if r.HostUUID == "" {
+		r.HostUUID = s.index.host()
+	}
+	return s.writeRecord(r)
+}
+
+// recordMount adds a mount reference for the given container and returns the number of references afterwards
+func (s *volumeStore) recordMount(name, id string) (int, error) {
+	count := 0
+	err := s.update(name, func(r *localRecord) {
+		count = r.MountRefs.add(id)
+		r.Mounted = true
+		r.LastMounted = time.Now().UTC()
+	})
+	return count, err
+}
+
+// releaseMount drops the mount reference for the given container and returns the number of references left
+func (s *volumeStore) releaseMount(name, id string) (int, error) {
+	count := 0
+	err := s.update(name, func(r *localRecord) {
+		count = r.MountRefs.remove(id)
+	})
+	return count, err
+}
+
+// recordUnmount marks the volume as no longer mounted on this host and drops any remaining mount references
+func (s *volumeStore) recordUnmount(name string) error {
+	return s.update(name, func(r *localRecord) {
+		r.MountRefs = mountRefRecord{}
+		r.Mounted = false
+	})
+}
+
+// recordRollbackPending marks the volume's stack as having to be deleted
+func (s *volumeStore) recordRollbackPending(name string) error {
+	return s.update(name, func(r *localRecord) {
+		r.RollbackPending = true
+	})
+}
+
+func (s *volumeStore) getVolumesInLocalCache() (map[string]bool, error) {
+	volumes := map[string]bool{}
+	files, err := ioutil.ReadDir(filepath.Join(s.rootDir, localCacheDir))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		// Skip temp files left behind by an interrupted write
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if _, ok := volumes[name]; !ok {
+			volumes[name] = false
+		}
+	}
+
+	return volumes, nil
+}
+
+// migrateLocalCache upgrades the empty marker files older versions of the driver wrote into records. Metadata is used
+// to fill in the volume's config if it is available. Mount references from the old mountrefs dir are then folded into
+// the records.
+func (s *volumeStore) migrateLocalCache() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	files, err := ioutil.ReadDir(filepath.Join(s.rootDir, localCacheDir))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasPrefix(name, ".") || f.Size() != 0 {
+			continue
+		}
+
+		r := &localRecord{
+			Version: localRecordVersion,
+			Name:    name,
+			Created: f.ModTime().UTC(),
+		}
+		if v, ok, err := s.index.get(name); err != nil {
+			logrus.Warnf("Couldn't get config for %v from metadata while migrating local cache: %v", name, err)
+		} else if ok {
+			r.Config = v.config
+			if v.onHost(s.index.host()) {
+				r.HostUUID = s.index.host()
+			}
+		}
+
+		logrus.Infof("Migrating local cache record for %v.", name)
+		if err := s.writeRecord(r); err != nil {
+			return err
+		}
+	}
+	return s.migrateMountRefs()
+}
+
+// migrateMountRefs moves the mount references in the old mountrefs dir into the records and removes the dir. A record
+// is written before its mountrefs file is removed, so merging is done in a way that can be repeated if the migration
+// is interrupted.
+func (s *volumeStore) migrateMountRefs() error {
+	dir := filepath.Join(s.rootDir, mountRefsDir)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Couldn't read mount reference dir. Error: %v", err)
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		// Skip temp files left behind by an interrupted write
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return fmt.Errorf("Couldn't read mount reference record for %v. Error: %v", name, err)
+		}
+		refs := mountRefRecord{}
+		if err := json.Unmarshal(data, &refs); err != nil {
+			return fmt.Errorf("Couldn't parse mount reference record for %v. Error: %v", name, err)
+		}
+
+		r, err := s.readRecord(name)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			r = &localRecord{
+				Name:     name,
+				Created:  f.ModTime().UTC(),
+				HostUUID: s.index.host(),
+			}
+		}
+		for _, id := range refs.IDs {
+			r.MountRefs.add(id)
+		}
+		if refs.Anonymous > r.MountRefs.Anonymous {
+			r.MountRefs.Anonymous = refs.Anonymous
+		}
+		if r.MountRefs.count() > 0 {
+			r.Mounted = true
+		}
+		r.Version = localRecordVersion
+
+		logrus.Infof("Migrating %v mount references of %v.", refs.count(), name)
+		if err := s.writeRecord(r); err != nil {
+			return err
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("Couldn't remove mount reference record for %v. Error: %v", name, err)
+		}
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("Couldn't remove mount reference dir. Error: %v", err)
+	}
+	return nil
+}
+
+func (s *volumeStore) readRecord(name string) (*localRecord, error) {
+	data, err := ioutil.ReadFile(s.recordFile(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Couldn't read local cache record for %v. Error: %v", name, err)
+	}
+
+	r := &localRecord{
+		Name: name,
+	}
+	// Empty marker files from before records were versioned are treated as records with no details
+	if len(data) == 0 {
+		return r, nil
+	}
+
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("Couldn't parse local cache record for %v. Error: %v", name, err)
+	}
+	if r.Version > localRecordVersion {
+		return nil, fmt.Errorf("Local cache record for %v has version %v. Only versions up to %v are supported.", name, r.Version, localRecordVersion)
+	}
+	return r, nil
+}
+
+func (s *volumeStore) writeRecord(r *localRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(s.recordFile(r.Name), data); err != nil {
+		return fmt.Errorf("Couldn't write local cache record for %v. Error: %v", r.Name, err)
+	}
+	return nil
+}
+
+func (s *volumeStore) recordFile(name string) string {
+	return filepath.Join(s.rootDir, localCacheDir, name)
+}
+
+// writeFileAtomic writes to a temp file in the same directory and renames it over the target so that readers never
+// see a partially written file
+func writeFileAtomic(file string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	md "github.com/rancher/go-rancher-metadata/metadata"
+
+	"github.com/rancher/docker-longhorn-driver/model"
+)
+
+func newTestStore(t *testing.T) (*volumeStore, func()) {
+	dir, err := ioutil.TempDir("", "localcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, localCacheDir), 0744); err != nil {
+		t.Fatal(err)
+	}
+
+	index := newVolumeIndex(md.NewClient("http://127.0.0.1:1"))
+	// An empty, already built index keeps the store from trying to reach metadata
+	index.volumes = map[string]indexedVolume{}
+	index.hostUUID = "host1"
+
+	store := &volumeStore{
+		mutex:   &sync.RWMutex{},
+		index:   index,
+		rootDir: dir,
+	}
+	return store, func() { os.RemoveAll(dir) }
+}
+
+func TestLocalRecordMountRefs(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+
+	if err := store.create("vol", volumeConfig{Name: "vol", FsType: "xfs"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectCount := func(count int, err error, expected int) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != expected {
+			t.Fatalf("Reference count is: %v. Expected %v", count, expected)
+		}
+	}
+
+	count, err := store.recordMount("vol", "c1")
+	expectCount(count, err, 1)
+	count, err = store.recordMount("vol", "c1")
+	expectCount(count, err, 1)
+	count, err = store.recordMount("vol", "c2")
+	expectCount(count, err, 2)
+	count, err = store.recordMount("vol", "")
+	expectCount(count, err, 3)
+
+	count, err = store.releaseMount("vol", "c1")
+	expectCount(count, err, 2)
+	count, err = store.releaseMount("vol", "")
+	expectCount(count, err, 1)
+	count, err = store.releaseMount("vol", "c2")
+	expectCount(count, err, 0)
+	count, err = store.releaseMount("vol", "")
+	expectCount(count, err, 0)
+
+	r, err := store.record("vol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Version != localRecordVersion || r.HostUUID != "host1" || r.Config.FsType != "xfs" || !r.Mounted || r.LastMounted.IsZero() || r.Created.IsZero() {
+		t.Fatalf("Unexpected record: %+v", r)
+	}
+
+	if err := store.recordUnmount("vol"); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ = store.record("vol"); r.Mounted {
+		t.Fatalf("Expected volume to be unmounted: %+v", r)
+	}
+}
+
+func TestMigrateLocalCache(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+
+	store.index.volumes["old"] = indexedVolume{
+		config:    volumeConfig{Name: "old", SizeGB: "10"},
+		hostUUIDs: []string{"host1"},
+	}
+	if err := ioutil.WriteFile(store.recordFile("old"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.migrateLocalCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := store.record("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Version != localRecordVersion || r.Config.SizeGB != "10" || r.HostUUID != "host1" || r.Created.IsZero() {
+		t.Fatalf("Unexpected record: %+v", r)
+	}
+
+	volumes, err := store.getVolumesInLocalCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 1 {
+		t.Fatalf("Unexpected volumes in local cache: %v", volumes)
+	}
+}
+
+func TestMigrateMountRefs(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+
+	// Mount references as written by drivers that kept them in their own dir
+	dir := filepath.Join(store.rootDir, mountRefsDir)
+	if err := os.MkdirAll(dir, 0744); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "shared"), []byte(`{"ids":["c1","c2"],"anonymous":1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(store.recordFile("shared"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.migrateLocalCache(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("Expected %v to be removed, got %v", dir, err)
+	}
+
+	r, err := store.record("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Version != localRecordVersion || !r.Mounted || r.MountRefs.count() != 3 {
+		t.Fatalf("Unexpected record: %+v", r)
+	}
+
+	// Releasing one of the migrated references leaves the others
+	count, err := store.releaseMount("shared", "c1")
+	if err != nil || count != 2 {
+		t.Fatalf("Unexpected count %v, %v", count, err)
+	}
+}
+
+func TestVolumeState(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+
+	mountInfo := filepath.Join(store.rootDir, "mountinfo")
+	line := "36 22 252:0 / " + mountPoint(store.rootDir, "mounted") + " rw,relatime - ext4 /dev/longhorn/mounted rw\n"
+	if err := ioutil.WriteFile(mountInfo, []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store.mounts = &mountTable{mountInfoFile: mountInfo}
+
+	for _, name := range []string{"mounted", "detached"} {
+		store.index.volumes[name] = indexedVolume{config: volumeConfig{Name: name}, hostUUIDs: []string{"host1"}, healthyReplicas: 2}
+	}
+	store.index.volumes["degraded"] = indexedVolume{config: volumeConfig{Name: "degraded"}, hostUUIDs: []string{"host1"}, healthyReplicas: 1}
+	store.index.volumes["moved"] = indexedVolume{config: volumeConfig{Name: "moved"}, hostUUIDs: []string{"host2"}, healthyReplicas: 2}
+	if err := store.create("moved", volumeConfig{Name: "moved"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"mounted":  model.StateMounted,
+		"detached": model.StateDetached,
+		"degraded": model.StateDegraded,
+		"moved":    model.StateMoved,
+	}
+	volumes, err := store.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != len(expected) {
+		t.Fatalf("Expected %v volumes, got %v", len(expected), volumes)
+	}
+	for _, v := range volumes {
+		if v.State != expected[v.Name] {
+			t.Fatalf("Expected volume %v to be %v, got %v", v.Name, expected[v.Name], v.State)
+		}
+		if (v.State == model.StateMounted) != (v.Mountpoint != "") {
+			t.Fatalf("Unexpected mountpoint %q of %v volume %v", v.Mountpoint, v.State, v.Name)
+		}
+	}
+
+	done := store.begin("detached", model.StateCreating)
+	if v, _, _, err := store.get("detached"); err != nil || v.State != model.StateCreating {
+		t.Fatalf("Expected creating volume, got %+v, %v", v, err)
+	}
+	done()
+	if v, _, _, err := store.get("detached"); err != nil || v.State != model.StateDetached {
+		t.Fatalf("Expected detached volume, got %+v, %v", v, err)
+	}
+}
+
+func TestExistingVolumeConfig(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+	d := &StorageDaemon{store: store}
+
+	store.index.volumes["moved"] = indexedVolume{
+		config:    volumeConfig{Name: "moved", Size: "53687091200", FsType: "xfs", Replicas: 3},
+		hostUUIDs: []string{"host2"},
+	}
+	requested := volumeConfig{Name: "moved", Size: "10737418240", FsType: "ext4"}
+
+	if config := d.existingVolumeConfig("moved", requested); config.Size != "53687091200" || config.FsType != "xfs" || config.Replicas != 3 {
+		t.Fatalf("Expected config from metadata, got %+v", config)
+	}
+	if config := d.existingVolumeConfig("unknown", requested); config.Size != requested.Size {
+		t.Fatalf("Expected requested config, got %+v", config)
+	}
+}
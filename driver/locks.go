@@ -0,0 +1,65 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// volumeLocks serializes operations on the same volume while letting operations on different volumes run in
+// parallel. A volume's lock only exists while it is held or waited for.
+type volumeLocks struct {
+	mutex sync.Mutex
+	locks map[string]*volumeLock
+	// Tracks operations holding a lock so that shutdown can wait for them
+	held sync.WaitGroup
+}
+
+type volumeLock struct {
+	// Holds a value while the lock is held. A channel rather than a mutex so that waiting can be cancelled.
+	sem chan struct{}
+	// The number of callers holding or waiting for the lock
+	refs int
+}
+
+func newVolumeLocks() *volumeLocks {
+	return &volumeLocks{
+		locks: map[string]*volumeLock{},
+	}
+}
+
+// lock blocks until no other operation holds the named volume's lock or ctx is cancelled, and returns the function
+// that releases the lock
+func (l *volumeLocks) lock(ctx context.Context, name string) (func(), error) {
+	l.mutex.Lock()
+	vl, ok := l.locks[name]
+	if !ok {
+		vl = &volumeLock{sem: make(chan struct{}, 1)}
+		l.locks[name] = vl
+	}
+	vl.refs++
+	l.mutex.Unlock()
+
+	select {
+	case vl.sem <- struct{}{}:
+	case <-ctx.Done():
+		l.release(name, vl)
+		return nil, fmt.Errorf("Gave up waiting for another operation on volume %v: %v", name, ctx.Err())
+	}
+
+	l.held.Add(1)
+	return func() {
+		<-vl.sem
+		l.release(name, vl)
+		l.held.Done()
+	}, nil
+}
+
+func (l *volumeLocks) release(name string, vl *volumeLock) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	vl.refs--
+	if vl.refs == 0 {
+		delete(l.locks, name)
+	}
+}
@@ -0,0 +1,71 @@
+package driver
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVolumeLocks(t *testing.T) {
+	locks := newVolumeLocks()
+	ctx := context.Background()
+
+	unlockFoo, err := locks.lock(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A different volume isn't blocked
+	done := make(chan bool)
+	go func() {
+		unlock, _ := locks.lock(ctx, "bar")
+		unlock()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Locking bar blocked on foo")
+	}
+
+	// The same volume is
+	acquired := make(chan bool)
+	released := make(chan bool)
+	go func() {
+		unlock, _ := locks.lock(ctx, "foo")
+		acquired <- true
+		unlock()
+		released <- true
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Locked foo twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Waiting can be cancelled
+	cancelled, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := locks.lock(cancelled, "foo"); err == nil {
+		t.Fatal("Expected error locking foo with a cancelled context")
+	}
+
+	unlockFoo()
+	<-acquired
+	<-released
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, _ := locks.lock(ctx, "foo")
+			unlock()
+		}()
+	}
+	wg.Wait()
+	if len(locks.locks) != 0 {
+		t.Fatalf("Expected released locks to be removed: %v", locks.locks)
+	}
+}
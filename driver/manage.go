@@ -0,0 +1,292 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rancher/docker-longhorn-driver/longhorn"
+	"github.com/rancher/docker-longhorn-driver/metrics"
+	"github.com/rancher/docker-longhorn-driver/model"
+	"github.com/rancher/docker-longhorn-driver/util"
+)
+
+// VolumeInfo describes a volume as reported by the management API
+type VolumeInfo struct {
+	Name string `json:"name"`
+	// One of the model.State* states: creating, deleting, moved, degraded, mounted, attached or detached
+	State string `json:"state"`
+	// UUID of the host the volume's controller is on, if known
+	Host       string       `json:"host,omitempty"`
+	Mountpoint string       `json:"mountpoint,omitempty"`
+	Config     volumeConfig `json:"config"`
+	Usage      *VolumeUsage `json:"usage"`
+}
+
+type SnapshotInfo struct {
+	Name string `json:"name"`
+}
+
+// Inspect returns the config, state and usage of a volume that resides, or resided, on this host
+func (d *StorageDaemon) Inspect(name string) (*VolumeInfo, error) {
+	vol, config, _, err := d.store.get(name)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting volume: %v", err)
+	}
+	if vol == nil {
+		return nil, errNoSuchVolume(name)
+	}
+
+	info := &VolumeInfo{
+		Name:       name,
+		State:      vol.State,
+		Mountpoint: vol.Mountpoint,
+		Config:     config,
+	}
+	info.Usage = volumeUsage(name, info.Mountpoint, config)
+
+	if indexed, ok, err := d.store.index.get(name); err != nil {
+		logrus.Warnf("Couldn't determine the host of volume %v: %v", name, err)
+	} else if ok && len(indexed.hostUUIDs) > 0 {
+		info.Host = indexed.hostUUIDs[0]
+	}
+	return info, nil
+}
+
+// InspectAll returns the config and state of every volume that resides, or resided, on this host
+func (d *StorageDaemon) InspectAll() ([]*VolumeInfo, error) {
+	volumes, err := d.store.list()
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []*VolumeInfo{}
+	for _, v := range volumes {
+		info, err := d.Inspect(v.Name)
+		if err != nil {
+			if statusCode(err) == http.StatusNotFound {
+				// Deleted since it was listed
+				continue
+			}
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// RegisterMetrics adds gauges of the volumes on this host to the registry
+func (d *StorageDaemon) RegisterMetrics(r prometheus.Registerer) {
+	countVolumes := func(count func(v *model.Volume) bool) float64 {
+		volumes, err := d.store.list()
+		if err != nil {
+			logrus.Warnf("Couldn't list volumes for metrics: %v", err)
+			return math.NaN()
+		}
+		n := 0
+		for _, v := range volumes {
+			if count(v) {
+				n++
+			}
+		}
+		return float64(n)
+	}
+
+	r.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "longhorn_volumes_mounted",
+		Help: "Number of volumes mounted on this host.",
+	}, func() float64 {
+		return countVolumes(func(v *model.Volume) bool { return v.Mountpoint != "" })
+	}))
+	r.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "longhorn_volumes_moved",
+		Help: "Number of volumes that were on this host and have moved to another.",
+	}, func() float64 {
+		return countVolumes(func(v *model.Volume) bool { return v.State == model.StateMoved })
+	}))
+	r.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "longhorn_volumes_degraded",
+		Help: "Number of volumes on this host with fewer healthy replicas than they have.",
+	}, func() float64 {
+		return countVolumes(func(v *model.Volume) bool { return v.State == model.StateDegraded })
+	}))
+}
+
+// CreateVolume creates a volume with the given options the same way docker volume create does
+func (d *StorageDaemon) CreateVolume(ctx context.Context, name string, opts map[string]string) (*VolumeInfo, error) {
+	if name == "" {
+		return nil, errInvalid(fmt.Errorf("Volume name is required."))
+	}
+	if opts == nil {
+		opts = map[string]string{}
+	}
+	if _, err := d.Create(ctx, &model.Volume{Name: name, Opts: opts}); err != nil {
+		return nil, err
+	}
+	return d.Inspect(name)
+}
+
+// volumeClient returns a client for the controller of the named volume, which may be on any host
+func (d *StorageDaemon) volumeClient(name string) (*longhorn.VolumeClient, error) {
+	_, ok, err := d.store.index.get(name)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't obtain volume %v from Rancher. Error: %v", name, err)
+	}
+	if !ok {
+		return nil, errNoSuchVolume(name)
+	}
+	return longhorn.NewVolumeClient(name), nil
+}
+
+func (d *StorageDaemon) Snapshots(ctx context.Context, name string) ([]SnapshotInfo, error) {
+	client, err := d.volumeClient(name)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := client.ListSnapshots(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing snapshots of volume %v: %v", name, err)
+	}
+	infos := []SnapshotInfo{}
+	for _, s := range snapshots {
+		infos = append(infos, SnapshotInfo{Name: s.Name})
+	}
+	return infos, nil
+}
+
+// CreateSnapshot snapshots the volume. Longhorn names the snapshot if no name is given.
+func (d *StorageDaemon) CreateSnapshot(ctx context.Context, name, snapshot string) (_ SnapshotInfo, err error) {
+	defer metrics.Observe("driver", "create_snapshot", time.Now(), &err)
+	defer d.auditLog.Record(ctx, "create-snapshot", name, map[string]string{"snapshot": snapshot}, time.Now(), &err)
+	client, err := d.volumeClient(name)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	logrus.Infof("Creating snapshot %v of volume %v", snapshot, name)
+	s, err := client.CreateSnapshot(ctx, snapshot)
+	if err != nil {
+		return SnapshotInfo{}, fmt.Errorf("Error creating snapshot of volume %v: %v", name, err)
+	}
+	return SnapshotInfo{Name: s.Name}, nil
+}
+
+func (d *StorageDaemon) DeleteSnapshot(ctx context.Context, name, snapshot string) (err error) {
+	defer metrics.Observe("driver", "delete_snapshot", time.Now(), &err)
+	defer d.auditLog.Record(ctx, "delete-snapshot", name, map[string]string{"snapshot": snapshot}, time.Now(), &err)
+	client, err := d.volumeClient(name)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Deleting snapshot %v of volume %v", snapshot, name)
+	if err := client.DeleteSnapshot(ctx, snapshot); err != nil {
+		return fmt.Errorf("Error deleting snapshot %v of volume %v: %v", snapshot, name, err)
+	}
+	return nil
+}
+
+// Backup backs up a snapshot of the volume to the backup target described by the backup-target-* options, waits for
+// the backup to finish and returns its URI, which can be given to the from-backup option or to Restore.
+func (d *StorageDaemon) Backup(ctx context.Context, name, snapshot string, opts map[string]string) (_ string, err error) {
+	defer metrics.Observe("driver", "backup", time.Now(), &err)
+	defer d.auditLog.Record(ctx, "backup", name, withOpt(opts, "snapshot", snapshot), time.Now(), &err)
+	target, err := backupTargetFromOpts(opts)
+	if err != nil {
+		return "", errInvalid(err)
+	}
+	client, err := d.volumeClient(name)
+	if err != nil {
+		return "", err
+	}
+
+	logrus.Infof("Backing up snapshot %v of volume %v to %v", snapshot, name, target.Name)
+	status, err := client.CreateBackup(ctx, snapshot, util.RandomID(), target)
+	if err != nil {
+		return "", fmt.Errorf("Error backing up snapshot %v of volume %v: %v", snapshot, name, err)
+	}
+
+	status, err = client.WaitForStatus(ctx, status, backupTimeout, fmt.Sprintf("backup of snapshot %v of volume %v", snapshot, name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(status.Message), nil
+}
+
+// Restore replaces the contents of a volume on this host with a backup. The volume must not be mounted.
+func (d *StorageDaemon) Restore(ctx context.Context, name, uri string, opts map[string]string) (err error) {
+	defer metrics.Observe("driver", "restore", time.Now(), &err)
+	defer d.auditLog.Record(ctx, "restore", name, withOpt(opts, "backup", uri), time.Now(), &err)
+	if uri == "" {
+		return errInvalid(fmt.Errorf("Backup URI is required."))
+	}
+	target, err := backupTargetFromOpts(opts)
+	if err != nil {
+		return errInvalid(err)
+	}
+
+	unlock, err := d.locks.lock(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	vol, _, moved, err := d.store.get(name)
+	if err != nil {
+		return fmt.Errorf("Error getting volume: %v", err)
+	}
+	if vol == nil {
+		return errNoSuchVolume(name)
+	}
+	if moved {
+		return errMoved(name, "restored")
+	}
+	inUse, err := d.volumeInUse(vol)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return errConflict("Volume %v is in use and cannot be restored.", name)
+	}
+
+	return restoreBackup(ctx, name, uri, target)
+}
+
+// volumeInUse returns whether containers on this host may be using the volume. Volumes created with dont-format have
+// no mount point, so their mount references and fake mount are checked too.
+func (d *StorageDaemon) volumeInUse(vol *model.Volume) (bool, error) {
+	if vol.Mountpoint != "" {
+		return true, nil
+	}
+
+	r, err := d.store.record(vol.Name)
+	if err != nil {
+		return false, err
+	}
+	if r != nil && r.MountRefs.count() > 0 {
+		return true, nil
+	}
+
+	if _, err := os.Stat(fakeMountPoint(d.rootDir, vol.Name)); err == nil {
+		return true, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	return false, nil
+}
+
+// withOpt returns a copy of opts with an extra option, for recording in the audit log
+func withOpt(opts map[string]string, key, value string) map[string]string {
+	result := map[string]string{key: value}
+	for k, v := range opts {
+		result[k] = v
+	}
+	return result
+}
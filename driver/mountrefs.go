@@ -0,0 +1,40 @@
+package driver
+
+// mountRefRecord tracks which containers on this host are using a mounted volume so that the filesystem is only
+// unmounted when the last of them is done with it. Mounts requested without a container ID can't be told apart, so
+// they are only counted.
+type mountRefRecord struct {
+	IDs       []string `json:"ids,omitempty"`
+	Anonymous int      `json:"anonymous,omitempty"`
+}
+
+func (r mountRefRecord) count() int {
+	return len(r.IDs) + r.Anonymous
+}
+
+// add records a mount by the given container and returns the number of references after adding it. Adding a
+// container ID that is already referencing the volume is a no-op.
+func (r *mountRefRecord) add(id string) int {
+	if id == "" {
+		r.Anonymous++
+	} else if !contains(r.IDs, id) {
+		r.IDs = append(r.IDs, id)
+	}
+	return r.count()
+}
+
+// remove drops the given container's reference and returns the number of references left
+func (r *mountRefRecord) remove(id string) int {
+	if id != "" && contains(r.IDs, id) {
+		ids := []string{}
+		for _, i := range r.IDs {
+			if i != id {
+				ids = append(ids, i)
+			}
+		}
+		r.IDs = ids
+	} else if r.Anonymous > 0 {
+		r.Anonymous--
+	}
+	return r.count()
+}
@@ -0,0 +1,144 @@
+package driver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	mountInfoFile = "/proc/self/mountinfo"
+)
+
+type mountEntry struct {
+	MountPoint string
+	Source     string
+	FsType     string
+	Options    string
+}
+
+// mountTable reports what is mounted in the driver's mount namespace by reading the kernel's mountinfo
+type mountTable struct {
+	mountInfoFile string
+}
+
+func newMountTable() *mountTable {
+	return &mountTable{
+		mountInfoFile: mountInfoFile,
+	}
+}
+
+func (t *mountTable) entries() ([]mountEntry, error) {
+	f, err := os.Open(t.mountInfoFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseMountInfo(f)
+}
+
+// get returns the entry mounted at mountPoint, or nil if nothing is. If mounts are stacked, the last one is returned
+// since that's the one that is visible.
+func (t *mountTable) get(mountPoint string) (*mountEntry, error) {
+	entries, err := t.entries()
+	if err != nil {
+		return nil, err
+	}
+
+	mountPoint = filepath.Clean(mountPoint)
+	var found *mountEntry
+	for i := range entries {
+		if entries[i].MountPoint == mountPoint {
+			found = &entries[i]
+		}
+	}
+	return found, nil
+}
+
+func (t *mountTable) isMounted(mountPoint string) (bool, error) {
+	entry, err := t.get(mountPoint)
+	return entry != nil, err
+}
+
+// mountPointsOf returns every mount point that the given device is mounted at
+func (t *mountTable) mountPointsOf(dev string) ([]string, error) {
+	entries, err := t.entries()
+	if err != nil {
+		return nil, err
+	}
+
+	mountPoints := []string{}
+	for _, e := range entries {
+		if sameDevice(e.Source, dev) {
+			mountPoints = append(mountPoints, e.MountPoint)
+		}
+	}
+	return mountPoints, nil
+}
+
+func sameDevice(a, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	resolvedA, errA := filepath.EvalSymlinks(a)
+	resolvedB, errB := filepath.EvalSymlinks(b)
+	return errA == nil && errB == nil && resolvedA == resolvedB
+}
+
+// parseMountInfo parses the format described in proc(5):
+// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func parseMountInfo(r io.Reader) ([]mountEntry, error) {
+	entries := []mountEntry{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 6 || sep == -1 || len(fields) < sep+3 {
+			return nil, fmt.Errorf("Couldn't parse mountinfo line %q.", line)
+		}
+
+		entries = append(entries, mountEntry{
+			MountPoint: unescapeMountInfo(fields[4]),
+			Options:    fields[5],
+			FsType:     fields[sep+1],
+			Source:     unescapeMountInfo(fields[sep+2]),
+		})
+	}
+	return entries, scanner.Err()
+}
+
+// The kernel escapes space, tab, newline and backslash in paths as three digit octal sequences
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
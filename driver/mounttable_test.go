@@ -0,0 +1,69 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const mountInfo = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw,errors=remount-ro
+36 22 252:0 / /var/lib/rancher/longhorn/mounts/db rw,noatime shared:30 - xfs /dev/longhorn/db rw,attr2
+37 22 252:1 / /var/lib/rancher/longhorn/mounts/db2 rw,relatime - ext4 /dev/longhorn/db2 rw
+38 22 0:45 / /var/lib/rancher/longhorn/mounts/with\040space rw master:2 unbindable - tmpfs tmpfs rw
+`
+
+func TestParseMountInfo(t *testing.T) {
+	entries, err := parseMountInfo(strings.NewReader(mountInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 4 {
+		t.Fatalf("Parsed %v entries. Expected 4", len(entries))
+	}
+
+	e := entries[1]
+	if e.MountPoint != "/var/lib/rancher/longhorn/mounts/db" || e.Source != "/dev/longhorn/db" || e.FsType != "xfs" || e.Options != "rw,noatime" {
+		t.Fatalf("Unexpected entry: %+v", e)
+	}
+
+	e = entries[3]
+	if e.MountPoint != "/var/lib/rancher/longhorn/mounts/with space" || e.FsType != "tmpfs" {
+		t.Fatalf("Unexpected entry: %+v", e)
+	}
+
+	if _, err := parseMountInfo(strings.NewReader("36 22 252:0 / /mnt rw\n")); err == nil {
+		t.Fatal("Expected error for truncated line")
+	}
+}
+
+func TestMountTableExactMatch(t *testing.T) {
+	f, err := ioutil.TempFile("", "mountinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(mountInfo)
+	f.Close()
+
+	table := &mountTable{mountInfoFile: f.Name()}
+
+	mounted, err := table.isMounted("/var/lib/rancher/longhorn/mounts/db")
+	if err != nil || !mounted {
+		t.Fatalf("Expected db to be mounted. Error: %v", err)
+	}
+
+	mounted, err = table.isMounted("/var/lib/rancher/longhorn/mounts/d")
+	if err != nil || mounted {
+		t.Fatalf("Expected d not to be mounted. Error: %v", err)
+	}
+
+	mps, err := table.mountPointsOf("/dev/longhorn/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mps) != 1 || mps[0] != "/var/lib/rancher/longhorn/mounts/db" {
+		t.Fatalf("Unexpected mount points for db: %v", mps)
+	}
+}
@@ -0,0 +1,234 @@
+package driver
+
+import (
+	"crypto/md5"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/rancher/docker-longhorn-driver/longhorn"
+	"github.com/rancher/docker-longhorn-driver/util"
+)
+
+// newVolumeConfig builds and validates the config of a new volume from the options given to docker volume create
+func newVolumeConfig(name string, opts map[string]string) (volumeConfig, error) {
+	sizeStr := opts[optSize]
+	dontFormat, _ := strconv.ParseBool(opts[optDontFormat])
+	encrypted, _ := strconv.ParseBool(opts[optEncrypted])
+
+	fsType := opts[optFsType]
+	if fsType == "" {
+		fsType = defaultFsType
+	}
+	if _, err := mkfsCommand(fsType, ""); err != nil {
+		return volumeConfig{}, err
+	}
+
+	if err := validateMountOptions(opts[optMountOptions]); err != nil {
+		return volumeConfig{}, err
+	}
+
+	if err := validateFsckPolicy(opts[optFsckPolicy]); err != nil {
+		return volumeConfig{}, err
+	}
+
+	if opts[optFromSnapshot] != "" {
+		if _, _, err := parseFromSnapshot(opts[optFromSnapshot]); err != nil {
+			return volumeConfig{}, err
+		}
+	}
+
+	if opts[optFromBackup] != "" {
+		if opts[optFromSnapshot] != "" {
+			return volumeConfig{}, fmt.Errorf("Options %v and %v can't be combined.", optFromSnapshot, optFromBackup)
+		}
+		if opts[optMkfsOptions] != "" || opts[optReplicaBaseImage] != "" {
+			return volumeConfig{}, fmt.Errorf("Options %v and %v can't be combined with %v.", optMkfsOptions, optReplicaBaseImage, optFromBackup)
+		}
+		if _, err := backupTargetFromOpts(opts); err != nil {
+			return volumeConfig{}, err
+		}
+		// The restored volume gets the backup's filesystem and must be at least as large as the backed up volume,
+		// neither of which the defaults can be assumed to match
+		if sizeStr == "" {
+			return volumeConfig{}, fmt.Errorf("Option %v requires the %v of the backed up volume.", optFromBackup, optSize)
+		}
+		if opts[optFsType] == "" && !dontFormat {
+			return volumeConfig{}, fmt.Errorf("Option %v requires the %v of the backed up volume.", optFromBackup, optFsType)
+		}
+	}
+
+	if opts[optFrontend] != "" {
+		if err := validateFrontend(opts[optFrontend]); err != nil {
+			return volumeConfig{}, err
+		}
+	}
+
+	replicas := defaultReplicas
+	if opts[optReplicas] != "" {
+		r, err := strconv.Atoi(opts[optReplicas])
+		if err != nil || r < 1 {
+			return volumeConfig{}, fmt.Errorf("Invalid %v option %q. Must be a positive number.", optReplicas, opts[optReplicas])
+		}
+		replicas = r
+	}
+
+	if sizeStr == "" {
+		if dontFormat {
+			sizeStr = "0b"
+		} else {
+			sizeStr = defaultVolumeSize
+		}
+		logrus.Infof("No size option provided. Using: %v", sizeStr)
+	}
+	size, sizeGB, err := util.ConvertSize(sizeStr)
+	if err != nil {
+		return volumeConfig{}, fmt.Errorf("Can't parse size %v. Error: %v", sizeStr, err)
+	}
+
+	return volumeConfig{
+		Name:                name,
+		Size:                size,
+		SizeGB:              sizeGB,
+		ReadIOPS:            opts[optReadIOPS],
+		WriteIOPS:           opts[optWriteIOPS],
+		ReplicaBaseImage:    opts[optReplicaBaseImage],
+		DontFormat:          dontFormat,
+		FsType:              fsType,
+		MkfsOptions:         opts[optMkfsOptions],
+		MountOptions:        opts[optMountOptions],
+		Encrypted:           encrypted,
+		EncryptionKeyFile:   opts[optEncryptionKeyFile],
+		EncryptionKeySecret: opts[optEncryptionKeySecret],
+		FsckPolicy:          opts[optFsckPolicy],
+		FromSnapshot:        opts[optFromSnapshot],
+		FromBackup:          opts[optFromBackup],
+		Replicas:            replicas,
+		Class:               opts[optClass],
+		Frontend:            opts[optFrontend],
+	}, nil
+}
+
+// opts reports the volume's config in terms of the options accepted by docker volume create
+func (v volumeConfig) opts() map[string]string {
+	opts := map[string]string{
+		optReplicas: strconv.Itoa(v.ReplicaCount()),
+		optFrontend: v.FrontendName(),
+	}
+	if v.Size != "" {
+		opts[optSize] = v.Size
+	}
+	if !v.DontFormat {
+		opts[optFsType] = v.fsType()
+	}
+	if v.Class != "" {
+		opts[optClass] = v.Class
+	}
+	return opts
+}
+
+// validateReplicas checks that there are enough hosts in the storage pool to place each replica on its own host
+func (d *StorageDaemon) validateReplicas(config volumeConfig) error {
+	hosts, err := d.storagePoolHosts()
+	if err != nil {
+		return fmt.Errorf("Couldn't determine the hosts in the storage pool. Error: %v", err)
+	}
+	if config.ReplicaCount() > len(hosts) {
+		return fmt.Errorf("Volume %v can't have %v replicas because there are only %v hosts in the storage pool.", config.Name, config.ReplicaCount(), len(hosts))
+	}
+	return nil
+}
+
+// storagePoolHosts returns the UUIDs of the hosts running the driver stack, which make up the storage pool
+func (d *StorageDaemon) storagePoolHosts() (map[string]bool, error) {
+	stack, err := d.metadata.GetSelfStack()
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := map[string]bool{}
+	for _, svc := range stack.Services {
+		for _, c := range svc.Containers {
+			hosts[c.HostUUID] = true
+		}
+	}
+	return hosts, nil
+}
+
+// parseFromSnapshot splits a from-snapshot option in the form <volume>/<snapshot>
+func parseFromSnapshot(fromSnapshot string) (string, string, error) {
+	parts := strings.Split(fromSnapshot, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("Invalid %v option %q. Expected <volume>/<snapshot>.", optFromSnapshot, fromSnapshot)
+	}
+	return parts[0], parts[1], nil
+}
+
+// Options that describe how to build a filesystem, which a clone can't change because it copies its source's
+var fsBuildOptions = []string{optFsType, optMkfsOptions, optDontFormat, optEncrypted, optEncryptionKeyFile, optEncryptionKeySecret, optReplicaBaseImage}
+
+// inheritFromSnapshotSource sets up the config of a volume cloned from a snapshot so that it matches the filesystem
+// of the source volume. The clone defaults to the source's size and can't be smaller.
+func (d *StorageDaemon) inheritFromSnapshotSource(config *volumeConfig, opts map[string]string) error {
+	srcName, _, err := parseFromSnapshot(config.FromSnapshot)
+	if err != nil {
+		return err
+	}
+
+	for _, opt := range fsBuildOptions {
+		if opts[opt] != "" {
+			return fmt.Errorf("Option %v can't be combined with %v. The volume keeps the filesystem of %v.", opt, optFromSnapshot, srcName)
+		}
+	}
+
+	if _, err := backupTargetFromOpts(opts); err != nil {
+		return err
+	}
+
+	src, ok, err := d.store.index.get(srcName)
+	if err != nil {
+		return fmt.Errorf("Couldn't look up source volume %v. Error: %v", srcName, err)
+	}
+	if !ok {
+		return fmt.Errorf("No such volume: %v", srcName)
+	}
+	if src.config.ReplicaBaseImage != "" {
+		return fmt.Errorf("Volume %v uses a base image and can't be cloned.", srcName)
+	}
+
+	config.FsType = src.config.fsType()
+	config.DontFormat = src.config.DontFormat
+	config.Encrypted = src.config.Encrypted
+	config.EncryptionKeyFile = src.config.EncryptionKeyFile
+	config.EncryptionKeySecret = src.config.EncryptionKeySecret
+
+	srcSize, _ := strconv.ParseInt(src.config.Size, 10, 64)
+	if opts[optSize] == "" {
+		config.Size = src.config.Size
+		config.SizeGB = src.config.SizeGB
+	} else if size, _ := strconv.ParseInt(config.Size, 10, 64); size < srcSize {
+		return fmt.Errorf("Size %v is smaller than the %v bytes of source volume %v.", opts[optSize], srcSize, srcName)
+	}
+	return nil
+}
+
+// backupTargetFromOpts returns the NFS backup target given in the volume's options
+func backupTargetFromOpts(opts map[string]string) (longhorn.BackupTarget, error) {
+	server, share := opts[optBackupNFSServer], opts[optBackupNFSShare]
+	if server == "" || share == "" {
+		return longhorn.BackupTarget{}, fmt.Errorf("Options %v and %v are required.", optBackupNFSServer, optBackupNFSShare)
+	}
+
+	return longhorn.BackupTarget{
+		Name: fmt.Sprintf("%v:%v", server, share),
+		// Longhorn keys backup target mounts on the UUID, so the same share must always get the same one
+		UUID: fmt.Sprintf("%x", md5.Sum([]byte(server+":"+share))),
+		NFSConfig: longhorn.NFSConfig{
+			Server:       server,
+			Share:        share,
+			MountOptions: opts[optBackupNFSOptions],
+		},
+	}, nil
+}
@@ -0,0 +1,99 @@
+package driver
+
+import (
+	"testing"
+)
+
+func TestNewVolumeConfig(t *testing.T) {
+	config, err := newVolumeConfig("foo", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Name != "foo" || config.SizeGB != "10" || config.FsType != "ext4" || config.Replicas != 2 {
+		t.Fatalf("Unexpected config: %+v", config)
+	}
+
+	config, err = newVolumeConfig("foo", map[string]string{optDontFormat: "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.DontFormat || config.Size != "0" {
+		t.Fatalf("Unexpected config: %+v", config)
+	}
+
+	invalid := []map[string]string{
+		{optSize: "ten"},
+		{optFsType: "ntfs"},
+		{optMountOptions: "bind"},
+		{optFsckPolicy: "always"},
+		{optReplicas: "0"},
+		{optReplicas: "two"},
+		{optFromSnapshot: "foo"},
+		{optFromBackup: "vfs:///var/lib/longhorn/backups/backup1"},
+		{optFromBackup: "vfs:///backup1", optFromSnapshot: "foo/bar", optBackupNFSServer: "1.2.3.4", optBackupNFSShare: "/nfs"},
+		{optFromBackup: "vfs:///backup1", optBackupNFSServer: "1.2.3.4", optBackupNFSShare: "/nfs", optFsType: "xfs"},
+		{optFromBackup: "vfs:///backup1", optBackupNFSServer: "1.2.3.4", optBackupNFSShare: "/nfs", optSize: "20g"},
+	}
+	for _, opts := range invalid {
+		if _, err := newVolumeConfig("foo", opts); err == nil {
+			t.Fatalf("Expected error for %v", opts)
+		}
+	}
+}
+
+func TestNewVolumeConfigFromBackup(t *testing.T) {
+	opts := map[string]string{
+		optFromBackup:      "vfs:///var/lib/longhorn/backups/backup1",
+		optBackupNFSServer: "1.2.3.4",
+		optBackupNFSShare:  "/var/nfs",
+		optFsType:          "xfs",
+		optSize:            "20g",
+	}
+	config, err := newVolumeConfig("foo", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.FromBackup != opts[optFromBackup] || config.FsType != "xfs" || config.SizeGB != "20" {
+		t.Fatalf("Unexpected config: %+v", config)
+	}
+}
+
+func TestParseFromSnapshot(t *testing.T) {
+	vol, snap, err := parseFromSnapshot("prod-db/nightly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol != "prod-db" || snap != "nightly" {
+		t.Fatalf("Unexpected volume %v and snapshot %v", vol, snap)
+	}
+
+	for _, s := range []string{"", "prod-db", "prod-db/", "/nightly", "a/b/c"} {
+		if _, _, err := parseFromSnapshot(s); err == nil {
+			t.Fatalf("Expected error for %q", s)
+		}
+	}
+}
+
+func TestBackupTargetFromOpts(t *testing.T) {
+	if _, err := backupTargetFromOpts(map[string]string{optBackupNFSServer: "1.2.3.4"}); err == nil {
+		t.Fatal("Expected error for missing share")
+	}
+
+	opts := map[string]string{optBackupNFSServer: "1.2.3.4", optBackupNFSShare: "/var/nfs"}
+	target, err := backupTargetFromOpts(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := backupTargetFromOpts(opts)
+	if target.UUID == "" || target.UUID != again.UUID || target.NFSConfig.Server != "1.2.3.4" || target.NFSConfig.Share != "/var/nfs" {
+		t.Fatalf("Unexpected target: %+v", target)
+	}
+}
+
+func TestQuorum(t *testing.T) {
+	for replicas, expected := range map[int]int{0: 1, 1: 1, 2: 1, 3: 2, 4: 2, 5: 3} {
+		if quorum := (volumeConfig{Replicas: replicas}).Quorum(); quorum != expected {
+			t.Fatalf("Quorum of %v replicas is %v. Expected %v", replicas, quorum, expected)
+		}
+	}
+}
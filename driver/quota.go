@@ -0,0 +1,103 @@
+package driver
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/docker/go-units"
+)
+
+// Quota limits the size of volumes. Zero fields are unlimited.
+type Quota struct {
+	// Maximum total size of the volumes, in GB
+	MaxProvisionedGB int64
+	// Maximum size of a single volume, in GB
+	MaxVolumeGB int64
+}
+
+// Quotas limit the volumes whose controller is on this host and all of the driver's volumes
+type Quotas struct {
+	Host   Quota
+	Driver Quota
+}
+
+func (q Quotas) validate() error {
+	for _, v := range []int64{q.Host.MaxProvisionedGB, q.Host.MaxVolumeGB, q.Driver.MaxProvisionedGB, q.Driver.MaxVolumeGB} {
+		if v < 0 {
+			return fmt.Errorf("Invalid quota %v. Quotas must be 0 for no limit or a positive number of GB.", v)
+		}
+	}
+	return nil
+}
+
+const (
+	quotaCreate = "create"
+	quotaResize = "resize"
+)
+
+// checkQuotas returns an error if creating the volume on this host, or resizing it to the size in its config, would
+// exceed a quota. Creating an existing volume isn't checked, so existing volumes can always be moved to this host.
+// Volumes are counted from metadata, which doesn't include volumes whose stacks are still being created.
+func (d *StorageDaemon) checkQuotas(operation string, config volumeConfig) error {
+	if d.quotas == (Quotas{}) {
+		return nil
+	}
+
+	volumes, hostUUID, err := d.store.index.list()
+	if err != nil {
+		return fmt.Errorf("Couldn't obtain volumes from Rancher to check quotas. Error: %v", err)
+	}
+	if _, ok := volumes[config.Name]; ok && operation == quotaCreate {
+		return nil
+	}
+	return checkQuotas(d.quotas, operation, config, volumes, hostUUID)
+}
+
+// checkQuotas checks the volume's size against the quotas. If the volume already exists, its size in the config
+// replaces its current size.
+func checkQuotas(quotas Quotas, operation string, config volumeConfig, volumes map[string]indexedVolume, hostUUID string) error {
+	var hostTotal, driverTotal int64
+	for name, v := range volumes {
+		if name == config.Name {
+			continue
+		}
+		size := sizeInBytes(v.config)
+		driverTotal += size
+		if v.onHost(hostUUID) {
+			hostTotal += size
+		}
+	}
+
+	size := sizeInBytes(config)
+	if err := checkQuota(quotas.Host, "host", size, hostTotal); err != nil {
+		return errQuotaExceeded("Can't %v volume %v: %v", operation, config.Name, err)
+	}
+	if err := checkQuota(quotas.Driver, "driver", size, driverTotal); err != nil {
+		return errQuotaExceeded("Can't %v volume %v: %v", operation, config.Name, err)
+	}
+	return nil
+}
+
+func checkQuota(quota Quota, scope string, size, total int64) error {
+	if quota.MaxVolumeGB > 0 && size > quota.MaxVolumeGB*units.GiB {
+		return fmt.Errorf("its size of %v exceeds the %v's maximum volume size of %v GB.", units.BytesSize(float64(size)), scope, quota.MaxVolumeGB)
+	}
+	if quota.MaxProvisionedGB > 0 && total+size > quota.MaxProvisionedGB*units.GiB {
+		left := quota.MaxProvisionedGB*units.GiB - total
+		if left < 0 {
+			left = 0
+		}
+		return fmt.Errorf("%v are already provisioned and the %v's quota is %v GB, leaving %v for a volume of %v.",
+			units.BytesSize(float64(total)), scope, quota.MaxProvisionedGB, units.BytesSize(float64(left)), units.BytesSize(float64(size)))
+	}
+	return nil
+}
+
+// sizeInBytes is the size of the volume in its config, or 0 if it has none
+func sizeInBytes(config volumeConfig) int64 {
+	size, err := strconv.ParseInt(config.Size, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return size
+}
@@ -0,0 +1,85 @@
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckQuotas(t *testing.T) {
+	volumes := map[string]indexedVolume{
+		"here":  {config: volumeConfig{Name: "here", Size: "10737418240"}, hostUUIDs: []string{"host1"}},
+		"there": {config: volumeConfig{Name: "there", Size: "21474836480"}, hostUUIDs: []string{"host2"}},
+	}
+	fiveGB := volumeConfig{Name: "new", Size: "5368709120"}
+
+	for _, test := range []struct {
+		quotas Quotas
+		config volumeConfig
+		ok     bool
+	}{
+		{Quotas{}, fiveGB, true},
+		{Quotas{Host: Quota{MaxVolumeGB: 5}}, fiveGB, true},
+		{Quotas{Host: Quota{MaxVolumeGB: 4}}, fiveGB, false},
+		{Quotas{Driver: Quota{MaxVolumeGB: 4}}, fiveGB, false},
+		{Quotas{Host: Quota{MaxProvisionedGB: 15}}, fiveGB, true},
+		{Quotas{Host: Quota{MaxProvisionedGB: 14}}, fiveGB, false},
+		{Quotas{Driver: Quota{MaxProvisionedGB: 35}}, fiveGB, true},
+		{Quotas{Driver: Quota{MaxProvisionedGB: 34}}, fiveGB, false},
+		// Resizing replaces the volume's current size
+		{Quotas{Host: Quota{MaxProvisionedGB: 15}}, volumeConfig{Name: "here", Size: "16106127360"}, true},
+		{Quotas{Host: Quota{MaxProvisionedGB: 14}}, volumeConfig{Name: "here", Size: "16106127360"}, false},
+		{Quotas{Host: Quota{MaxVolumeGB: 14}}, volumeConfig{Name: "here", Size: "16106127360"}, false},
+	} {
+		err := checkQuotas(test.quotas, quotaCreate, test.config, volumes, "host1")
+		if test.ok && err != nil {
+			t.Fatalf("Unexpected error for %+v: %v", test.quotas, err)
+		}
+		if !test.ok && (err == nil || statusCode(err) != http.StatusForbidden) {
+			t.Fatalf("Expected quota error for %+v, got %v", test.quotas, err)
+		}
+	}
+}
+
+func TestValidateQuotas(t *testing.T) {
+	if err := (Quotas{Host: Quota{MaxProvisionedGB: 100}}).validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (Quotas{Driver: Quota{MaxVolumeGB: -1}}).validate(); err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestQuotasOfExistingVolumes(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+
+	mountInfo := filepath.Join(store.rootDir, "mountinfo")
+	if err := ioutil.WriteFile(mountInfo, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	store.mounts = &mountTable{mountInfoFile: mountInfo}
+	store.index.volumes["here"] = indexedVolume{config: volumeConfig{Name: "here", Size: "10737418240"}, hostUUIDs: []string{"host1"}}
+	store.index.volumes["there"] = indexedVolume{config: volumeConfig{Name: "there", Size: "21474836480"}, hostUUIDs: []string{"host2"}}
+
+	d := &StorageDaemon{
+		locks:   newVolumeLocks(),
+		store:   store,
+		mounts:  store.mounts,
+		rootDir: store.rootDir,
+		quotas:  Quotas{Host: Quota{MaxProvisionedGB: 12}},
+	}
+
+	// Existing volumes aren't provisioned again when they move to this host
+	if err := d.checkQuotas(quotaCreate, volumeConfig{Name: "there", Size: "21474836480"}); err != nil {
+		t.Fatalf("Unexpected error moving volume: %v", err)
+	}
+
+	// The quota is checked before the stack is upgraded
+	err := d.Resize(context.Background(), "here", "13g")
+	if err == nil || statusCode(err) != http.StatusForbidden {
+		t.Fatalf("Expected quota error resizing volume, got %v", err)
+	}
+}
@@ -0,0 +1,240 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+type reconcileSummary struct {
+	staleMounts     []string
+	staleFakeMounts []string
+	orphanRecords   []string
+	resetRecords    []string
+	// Volumes whose interrupted creation was rolled back
+	rolledBack []string
+	// Stale mounts that containers still hold references to
+	inUse  []string
+	errors []string
+}
+
+func (s *reconcileSummary) String() string {
+	return fmt.Sprintf("stale mounts: %v, stale fake mounts: %v, orphan cache records: %v, reset cache records: %v, rolled back: %v, in use: %v, errors: %v",
+		s.staleMounts, s.staleFakeMounts, s.orphanRecords, s.resetRecords, s.rolledBack, s.inUse, s.errors)
+}
+
+// Reconcile finishes rollbacks of creates that were interrupted and brings the mount points and local cache on this
+// host in line with Rancher metadata. Mounts of volumes that have moved to another host or been deleted are unmounted,
+// records of deleted volumes are removed and records that claim a volume is mounted when it isn't are reset. Mounts
+// that containers still reference are left alone, as is everything but rollbacks if metadata lists no volumes at all,
+// since metadata may not be fully populated yet. With dryRun, only logs what would be done.
+func (d *StorageDaemon) Reconcile(dryRun bool) error {
+	logrus.Infof("Reconciling mounts and local cache with Rancher metadata. Dry run: %v", dryRun)
+	summary := &reconcileSummary{}
+	prefix := ""
+	if dryRun {
+		prefix = "[dry run] "
+	}
+	fail := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		logrus.Warn(msg)
+		summary.errors = append(summary.errors, msg)
+	}
+
+	inLocalCache, err := d.store.getVolumesInLocalCache()
+	if err != nil {
+		return err
+	}
+	// Rollbacks of creates that were interrupted, for example by the driver being stopped, only need Cattle
+	for name := range inLocalCache {
+		r, err := d.store.record(name)
+		if err != nil || r == nil || !r.RollbackPending {
+			continue
+		}
+		logrus.Infof("%vFinishing rollback of volume %v.", prefix, name)
+		summary.rolledBack = append(summary.rolledBack, name)
+		if dryRun {
+			continue
+		}
+		stack := newStack(name, d.driverContainerName, d.driverName, d.volumeStackImage, d.template, r.Config, d.client)
+		if err := d.rollbackStack(stack); err != nil {
+			fail("Couldn't roll back stack of volume %v: %v", name, err)
+			continue
+		}
+		if err := d.store.delete(name); err != nil {
+			fail("%v", err)
+		}
+	}
+
+	volumes, hostUUID, err := d.store.index.list()
+	if err != nil {
+		return fmt.Errorf("Couldn't obtain list of volumes from Rancher. Error: %v", err)
+	}
+	if len(volumes) == 0 {
+		logrus.Warnf("Rancher metadata lists no volumes. Skipping reconciliation in case metadata is incomplete.")
+		return nil
+	}
+	onHost := map[string]indexedVolume{}
+	for name, v := range volumes {
+		if v.onHost(hostUUID) {
+			onHost[name] = v
+		}
+	}
+
+	mounts, err := listDir(filepath.Join(d.rootDir, mountsDir))
+	if err != nil {
+		return err
+	}
+	for _, name := range mounts {
+		if _, ok := onHost[name]; ok {
+			continue
+		}
+		r, err := d.store.record(name)
+		if err != nil {
+			fail("%v", err)
+		}
+		if r != nil && r.MountRefs.count() > 0 {
+			mounted, err := d.mounts.isMounted(mountPoint(d.rootDir, name))
+			if err != nil || mounted {
+				logrus.Warnf("Not unmounting volume %v, which is no longer on this host, because containers still use it.", name)
+				summary.inUse = append(summary.inUse, name)
+				continue
+			}
+		}
+		logrus.Infof("%vUnmounting stale mount of volume %v.", prefix, name)
+		summary.staleMounts = append(summary.staleMounts, name)
+		if dryRun {
+			continue
+		}
+		config := volumeConfig{}
+		if r != nil {
+			config = r.Config
+		}
+		vol := d.store.constructVolume(name, config, indexedVolume{}, true)
+		if err := d.volumeUnmount(vol, config); err != nil {
+			fail("Couldn't unmount stale mount of volume %v: %v", name, err)
+		} else if r != nil {
+			if err := d.store.recordUnmount(name); err != nil {
+				fail("%v", err)
+			}
+		}
+		// Encryption may not be recorded for volumes created by older versions, so always make sure the mapping is gone
+		if err := luksClose(name); err != nil {
+			fail("Couldn't close encrypted mapping of volume %v: %v", name, err)
+		}
+	}
+
+	fakeMounts, err := listDir(filepath.Join(d.rootDir, fakeMountsDir))
+	if err != nil {
+		return err
+	}
+	for _, name := range fakeMounts {
+		if _, ok := onHost[name]; ok {
+			continue
+		}
+		// Whether a fake mount is in use can't be told from the mount table, only from its references
+		if r, err := d.store.record(name); err == nil && r != nil && r.MountRefs.count() > 0 {
+			logrus.Warnf("Not removing fake mount of volume %v, which is no longer on this host, because containers still use it.", name)
+			summary.inUse = append(summary.inUse, name)
+			continue
+		}
+		logrus.Infof("%vRemoving stale fake mount of volume %v.", prefix, name)
+		summary.staleFakeMounts = append(summary.staleFakeMounts, name)
+		if dryRun {
+			continue
+		}
+		if err := os.Remove(fakeMountPoint(d.rootDir, name)); err != nil {
+			fail("Couldn't remove stale fake mount of volume %v: %v", name, err)
+		}
+	}
+
+	inLocalCache, err = d.store.getVolumesInLocalCache()
+	if err != nil {
+		return err
+	}
+	for name := range inLocalCache {
+		if _, ok := onHost[name]; !ok {
+			// Records of volumes that moved are kept so they are reported as moved
+			if _, exists := volumes[name]; exists {
+				continue
+			}
+			if r, err := d.store.record(name); err == nil && r != nil && r.MountRefs.count() > 0 {
+				logrus.Warnf("Keeping local cache record of deleted volume %v because containers still use it.", name)
+				continue
+			} else if err == nil && r != nil && r.RollbackPending {
+				// Kept so that the rollback is retried
+				continue
+			}
+			logrus.Infof("%vRemoving local cache record of deleted volume %v.", prefix, name)
+			summary.orphanRecords = append(summary.orphanRecords, name)
+			if dryRun {
+				continue
+			}
+			if err := d.store.delete(name); err != nil {
+				fail("%v", err)
+			}
+			continue
+		}
+
+		r, err := d.store.record(name)
+		if err != nil {
+			fail("%v", err)
+			continue
+		}
+		if r == nil || !r.Mounted {
+			continue
+		}
+		mp := mountPoint(d.rootDir, name)
+		if r.Config.DontFormat {
+			mp = fakeMountPoint(d.rootDir, name)
+		}
+		if mounted, err := d.isMountedOrExists(mp, r.Config); err != nil {
+			fail("Couldn't determine if volume %v is mounted: %v", name, err)
+		} else if !mounted {
+			logrus.Infof("%vResetting mount state of volume %v which is no longer mounted.", prefix, name)
+			summary.resetRecords = append(summary.resetRecords, name)
+			if dryRun {
+				continue
+			}
+			if err := d.store.recordUnmount(name); err != nil {
+				fail("%v", err)
+			}
+		}
+	}
+
+	logrus.Infof("%vReconciliation finished. %v", prefix, summary)
+	return nil
+}
+
+// Fake mounts are plain directories, so they are considered mounted if they exist
+func (d *StorageDaemon) isMountedOrExists(mp string, config volumeConfig) (bool, error) {
+	if config.DontFormat {
+		_, err := os.Stat(mp)
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	return d.mounts.isMounted(mp)
+}
+
+func listDir(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, f := range files {
+		if f.IsDir() && !strings.HasPrefix(f.Name(), ".") {
+			names = append(names, f.Name())
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,189 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReconcile(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+
+	// A volume that moved while containers on this host still use it
+	mountInfo := filepath.Join(store.rootDir, "mountinfo")
+	line := "36 22 252:0 / " + mountPoint(store.rootDir, "inuse") + " rw,relatime - ext4 /dev/longhorn/inuse rw\n"
+	if err := ioutil.WriteFile(mountInfo, []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store.mounts = &mountTable{mountInfoFile: mountInfo}
+
+	d := &StorageDaemon{
+		store:   store,
+		mounts:  store.mounts,
+		rootDir: store.rootDir,
+	}
+
+	store.index.volumes["here"] = indexedVolume{hostUUIDs: []string{"host1"}}
+	store.index.volumes["moved"] = indexedVolume{hostUUIDs: []string{"host2"}}
+	store.index.volumes["inuse"] = indexedVolume{hostUUIDs: []string{"host2"}}
+	for _, name := range []string{"here", "moved", "inuse", "deleted"} {
+		if err := store.create(name, volumeConfig{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+		if name == "deleted" {
+			continue
+		}
+		if _, err := store.recordMount(name, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{mountPoint(store.rootDir, "moved"), mountPoint(store.rootDir, "inuse"), fakeMountPoint(store.rootDir, "deleted")} {
+		if err := os.MkdirAll(dir, 0744); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := d.Reconcile(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(mountPoint(store.rootDir, "moved")); err != nil {
+		t.Fatalf("Dry run removed stale mount point: %v", err)
+	}
+	if r, _ := store.record("deleted"); r == nil {
+		t.Fatal("Dry run removed orphan record")
+	}
+
+	if err := d.Reconcile(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(mountPoint(store.rootDir, "moved")); !os.IsNotExist(err) {
+		t.Fatalf("Expected stale mount point to be removed: %v", err)
+	}
+	if _, err := os.Stat(fakeMountPoint(store.rootDir, "deleted")); !os.IsNotExist(err) {
+		t.Fatalf("Expected stale fake mount point to be removed: %v", err)
+	}
+	if r, _ := store.record("deleted"); r != nil {
+		t.Fatalf("Expected orphan record to be removed: %+v", r)
+	}
+	if r, _ := store.record("moved"); r == nil || r.Mounted {
+		t.Fatalf("Expected record of moved volume to be kept and marked unmounted: %+v", r)
+	}
+	if r, _ := store.record("here"); r == nil || r.Mounted || r.MountRefs.count() != 0 {
+		t.Fatalf("Expected mount state of unmounted volume to be reset: %+v", r)
+	}
+	if _, err := os.Stat(mountPoint(store.rootDir, "inuse")); err != nil {
+		t.Fatalf("Expected mount point still in use to be kept: %v", err)
+	}
+	if r, _ := store.record("inuse"); r == nil || r.MountRefs.count() != 1 {
+		t.Fatalf("Expected mount references of volume still in use to be kept: %+v", r)
+	}
+}
+
+func TestReconcileWithoutVolumesInMetadata(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+	store.mounts = &mountTable{mountInfoFile: filepath.Join(store.rootDir, "mountinfo")}
+
+	d := &StorageDaemon{
+		store:   store,
+		mounts:  store.mounts,
+		rootDir: store.rootDir,
+	}
+
+	if err := store.create("vol1", volumeConfig{Name: "vol1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(mountPoint(store.rootDir, "vol1"), 0744); err != nil {
+		t.Fatal(err)
+	}
+
+	// Metadata that doesn't list any volumes may not be populated yet
+	if err := d.Reconcile(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(mountPoint(store.rootDir, "vol1")); err != nil {
+		t.Fatalf("Expected mount point to be kept: %v", err)
+	}
+	if r, _ := store.record("vol1"); r == nil {
+		t.Fatal("Expected record to be kept")
+	}
+}
+
+func TestReconcileAfterAllVolumesLeftHost(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+	mountInfo := filepath.Join(store.rootDir, "mountinfo")
+	if err := ioutil.WriteFile(mountInfo, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	store.mounts = &mountTable{mountInfoFile: mountInfo}
+
+	d := &StorageDaemon{
+		store:   store,
+		mounts:  store.mounts,
+		rootDir: store.rootDir,
+	}
+
+	store.index.volumes["moved"] = indexedVolume{hostUUIDs: []string{"host2"}}
+	for _, name := range []string{"moved", "deleted"} {
+		if err := store.create(name, volumeConfig{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{mountPoint(store.rootDir, "moved"), fakeMountPoint(store.rootDir, "deleted")} {
+		if err := os.MkdirAll(dir, 0744); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := d.Reconcile(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(mountPoint(store.rootDir, "moved")); !os.IsNotExist(err) {
+		t.Fatalf("Expected stale mount point to be removed: %v", err)
+	}
+	if _, err := os.Stat(fakeMountPoint(store.rootDir, "deleted")); !os.IsNotExist(err) {
+		t.Fatalf("Expected stale fake mount point to be removed: %v", err)
+	}
+	if r, _ := store.record("deleted"); r != nil {
+		t.Fatalf("Expected orphan record to be removed: %+v", r)
+	}
+	if r, _ := store.record("moved"); r == nil {
+		t.Fatal("Expected record of moved volume to be kept")
+	}
+}
+
+func TestReconcileKeepsPendingRollbacks(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+	mountInfo := filepath.Join(store.rootDir, "mountinfo")
+	if err := ioutil.WriteFile(mountInfo, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	store.mounts = &mountTable{mountInfoFile: mountInfo}
+
+	d := &StorageDaemon{
+		store:   store,
+		mounts:  store.mounts,
+		rootDir: store.rootDir,
+	}
+
+	store.index.volumes["here"] = indexedVolume{hostUUIDs: []string{"host1"}}
+	if err := store.create("interrupted", volumeConfig{Name: "interrupted"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.recordRollbackPending("interrupted"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The record of a volume that isn't in metadata is kept until its rollback is finished
+	if err := d.Reconcile(true); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := store.record("interrupted"); r == nil || !r.RollbackPending {
+		t.Fatalf("Expected record with pending rollback to be kept: %+v", r)
+	}
+}
@@ -0,0 +1,65 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/rancher/docker-longhorn-driver/longhorn"
+	"github.com/rancher/docker-longhorn-driver/util"
+)
+
+const (
+	backupTimeout = 12 * time.Hour
+)
+
+// populateFromSnapshot copies a snapshot of another volume into a newly created volume. Longhorn can't clone a
+// snapshot directly, so the snapshot is backed up to the given target, restored into the new volume and the
+// intermediate backup is removed.
+func populateFromSnapshot(ctx context.Context, config volumeConfig, target longhorn.BackupTarget) error {
+	srcName, snapshot, err := parseFromSnapshot(config.FromSnapshot)
+	if err != nil {
+		return err
+	}
+
+	src := longhorn.NewVolumeClient(srcName)
+	backupID := util.RandomID()
+	logrus.Infof("Backing up snapshot %v of volume %v to clone it into %v", snapshot, srcName, config.Name)
+	status, err := src.CreateBackup(ctx, snapshot, backupID, target)
+	if err != nil {
+		return fmt.Errorf("Error backing up snapshot %v: %v", config.FromSnapshot, err)
+	}
+
+	status, err = src.WaitForStatus(ctx, status, backupTimeout, fmt.Sprintf("backup of snapshot %v", config.FromSnapshot))
+	if err != nil {
+		return err
+	}
+
+	uri := strings.TrimSpace(status.Message)
+	defer func() {
+		// Clean up even if ctx was cancelled during the restore
+		ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+		defer cancel()
+		if _, err := src.RemoveBackup(ctx, snapshot, backupID, uri, target); err != nil {
+			logrus.Warnf("Couldn't remove intermediate backup %v of snapshot %v: %v", uri, config.FromSnapshot, err)
+		}
+	}()
+
+	return restoreBackup(ctx, config.Name, uri, target)
+}
+
+// restoreBackup restores the backup at uri into the volume and waits for the restore to finish
+func restoreBackup(ctx context.Context, volumeName, uri string, target longhorn.BackupTarget) error {
+	logrus.Infof("Restoring backup %v into volume %v", uri, volumeName)
+	client := longhorn.NewVolumeClient(volumeName)
+	status, err := client.RestoreFromBackup(ctx, util.RandomID(), uri, target)
+	if err != nil {
+		return fmt.Errorf("Error restoring backup %v into volume %v: %v", uri, volumeName, err)
+	}
+
+	_, err = client.WaitForStatus(ctx, status, backupTimeout, fmt.Sprintf("restore of backup %v into volume %v", uri, volumeName))
+	return err
+}
@@ -1,12 +1,12 @@
 package driver
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"text/template"
 	"time"
 
-	"bytes"
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/docker-longhorn-driver/util"
 	rancherClient "github.com/rancher/go-rancher/client"
@@ -15,11 +15,13 @@ import (
 const (
 	retryInterval          = 2 * time.Second
 	retryMax               = 1800
+	rollbackTimeout        = 10 * time.Minute
 	composeAffinityLabel   = "io.rancher.scheduler.affinity:container"
 	composeVolumeName      = "VOLUME_NAME"
 	composeVolumeSize      = "VOLUME_SIZE"
 	composeDriverContainer = "DRIVER_CONTAINER"
 	composeImage           = "IMAGE"
+	composeTemplateVersion = "TEMPLATE_VERSION"
 )
 
 var composeTemplate *template.Template
@@ -41,14 +43,16 @@ type stack struct {
 	driverContainerName string
 	driver              string
 	volumeConfig        volumeConfig
+	template            *StackTemplate
 }
 
-func newStack(volumeName, driverContainerName, driver, image string, volConfig volumeConfig, rancherClient *rancherClient.RancherClient) *stack {
+func newStack(volumeName, driverContainerName, driver, image string, tmplt *StackTemplate, volConfig volumeConfig, rancherClient *rancherClient.RancherClient) *stack {
 	env := map[string]interface{}{
 		composeImage:           image,
 		composeVolumeName:      volumeName,
 		composeVolumeSize:      volConfig.Size,
 		composeDriverContainer: driverContainerName,
+		composeTemplateVersion: tmplt.Version,
 	}
 
 	stackName := util.VolumeToStackName(volumeName)
@@ -59,50 +63,102 @@ func newStack(volumeName, driverContainerName, driver, image string, volConfig v
 		environment:         env,
 		driverContainerName: driverContainerName,
 		volumeConfig:        volConfig,
+		template:            tmplt,
 	}
 }
 
-func (s *stack) create() (*rancherClient.Environment, error) {
+func (s *stack) create(ctx context.Context) (*rancherClient.Environment, error) {
 	env, err := s.find()
 	if err != nil {
 		return nil, err
 	}
 
-	dockerCompose := new(bytes.Buffer)
-	if err := composeTemplate.Execute(dockerCompose, s.volumeConfig); err != nil {
-		return nil, fmt.Errorf("Error generating docker compose: %v", err)
+	dockerCompose, err := s.dockerCompose()
+	if err != nil {
+		return nil, err
 	}
 
 	config := &rancherClient.Environment{
 		Name:          s.name,
 		ExternalId:    s.externalID,
 		Environment:   s.environment,
-		DockerCompose: dockerCompose.String(),
+		DockerCompose: dockerCompose,
 		StartOnCreate: true,
 	}
 
-	if env == nil {
+	created := env == nil
+	if created {
 		env, err = s.rancherClient.Environment.Create(config)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	if err := WaitEnvironment(s.rancherClient, env); err != nil {
+	if err := WaitEnvironment(ctx, s.rancherClient, env); err != nil {
 		return nil, err
 	}
 
-	if err := s.waitForServices(env, "active"); err != nil {
-		logrus.Debugf("Failed waiting services to be ready to launch. Cleaning up %v", env.Name)
-		if err := s.rancherClient.Environment.Delete(env); err != nil {
-			return nil, err
+	if err := s.waitForServices(ctx, env, "active"); err != nil {
+		// Only clean up a stack this call created. An existing stack holds the volume's data.
+		if created {
+			logrus.Debugf("Failed waiting services to be ready to launch. Cleaning up %v", env.Name)
+			if err := s.rancherClient.Environment.Delete(env); err != nil {
+				return nil, err
+			}
 		}
+		return nil, err
 	}
 
 	return env, nil
 }
 
-func (s *stack) delete() error {
+func (s *stack) dockerCompose() (string, error) {
+	return s.template.render(s.volumeConfig)
+}
+
+// upgrade applies the stack's current volume config and environment to an existing stack
+func (s *stack) upgrade(ctx context.Context) error {
+	env, err := s.find()
+	if err != nil {
+		return err
+	}
+	if env == nil {
+		return fmt.Errorf("Couldn't find stack %v to upgrade", s.name)
+	}
+
+	dockerCompose, err := s.dockerCompose()
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Upgrading stack %v", s.name)
+	env, err = s.rancherClient.Environment.ActionUpgrade(env, &rancherClient.EnvironmentUpgrade{
+		DockerCompose: dockerCompose,
+		Environment:   s.environment,
+		ExternalId:    s.externalID,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := WaitEnvironment(ctx, s.rancherClient, env); err != nil {
+		return err
+	}
+
+	if env.State == "upgraded" {
+		env, err = s.rancherClient.Environment.ActionFinishupgrade(env)
+		if err != nil {
+			return err
+		}
+		if err := WaitEnvironment(ctx, s.rancherClient, env); err != nil {
+			return err
+		}
+	}
+
+	return s.waitForServices(ctx, env, "active")
+}
+
+func (s *stack) delete(ctx context.Context) error {
 	env, err := s.find()
 	if err != nil || env == nil {
 		return err
@@ -112,7 +168,7 @@ func (s *stack) delete() error {
 		return err
 	}
 
-	return WaitEnvironment(s.rancherClient, env)
+	return WaitEnvironment(ctx, s.rancherClient, env)
 }
 
 func (s *stack) find() (*rancherClient.Environment, error) {
@@ -137,7 +193,7 @@ func (s *stack) find() (*rancherClient.Environment, error) {
 	return &envs.Data[0], nil
 }
 
-func (s *stack) confirmControllerUpgrade(env *rancherClient.Environment) (*rancherClient.Service, error) {
+func (s *stack) confirmControllerUpgrade(ctx context.Context, env *rancherClient.Environment) (*rancherClient.Service, error) {
 	services, err := s.rancherClient.Service.List(&rancherClient.ListOpts{
 		Filters: map[string]interface{}{
 			"environmentId": env.Id,
@@ -153,7 +209,7 @@ func (s *stack) confirmControllerUpgrade(env *rancherClient.Environment) (*ranch
 	}
 
 	controller := &services.Data[0]
-	if err := WaitService(s.rancherClient, controller); err != nil {
+	if err := WaitService(ctx, s.rancherClient, controller); err != nil {
 		return nil, err
 	}
 
@@ -162,7 +218,7 @@ func (s *stack) confirmControllerUpgrade(env *rancherClient.Environment) (*ranch
 		if err != nil {
 			return nil, err
 		}
-		err = WaitService(s.rancherClient, controller)
+		err = WaitService(ctx, s.rancherClient, controller)
 		if err != nil {
 			return nil, err
 		}
@@ -171,13 +227,13 @@ func (s *stack) confirmControllerUpgrade(env *rancherClient.Environment) (*ranch
 	return controller, nil
 }
 
-func (s *stack) moveController() error {
+func (s *stack) moveController(ctx context.Context) error {
 	env, err := s.find()
 	if err != nil {
 		return err
 	}
 
-	controller, err := s.confirmControllerUpgrade(env)
+	controller, err := s.confirmControllerUpgrade(ctx, env)
 	if err != nil {
 		return err
 	}
@@ -195,7 +251,7 @@ func (s *stack) moveController() error {
 		if err != nil {
 			return err
 		}
-		if _, err := s.confirmControllerUpgrade(env); err != nil {
+		if _, err := s.confirmControllerUpgrade(ctx, env); err != nil {
 			return err
 		}
 	}
@@ -203,7 +259,7 @@ func (s *stack) moveController() error {
 	return nil
 }
 
-func (s *stack) waitForServices(env *rancherClient.Environment, targetState string) error {
+func (s *stack) waitForServices(ctx context.Context, env *rancherClient.Environment, targetState string) error {
 	var serviceCollection rancherClient.ServiceCollection
 	ready := false
 
@@ -214,7 +270,11 @@ func (s *stack) waitForServices(env *rancherClient.Environment, targetState stri
 
 	for i := 0; !ready && i < retryMax; i++ {
 		logrus.Debugf("Waiting for %v services in %v turn to %v state", targetServiceCount, env.Name, targetState)
-		time.Sleep(retryInterval)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Stopped waiting for services in %v to turn to %v state: %v", env.Name, targetState, ctx.Err())
+		case <-time.After(retryInterval):
+		}
 		if err := s.rancherClient.GetLink(env.Resource, "services", &serviceCollection); err != nil {
 			return err
 		}
@@ -241,8 +301,8 @@ func (s *stack) waitForServices(env *rancherClient.Environment, targetState stri
 	return nil
 }
 
-func (s *stack) waitActive(service *rancherClient.Service) (*rancherClient.Service, error) {
-	err := WaitService(s.rancherClient, service)
+func (s *stack) waitActive(ctx context.Context, service *rancherClient.Service) (*rancherClient.Service, error) {
+	err := WaitService(ctx, s.rancherClient, service)
 	if err != nil || service.State != "upgraded" {
 		return service, err
 	}
@@ -251,7 +311,7 @@ func (s *stack) waitActive(service *rancherClient.Service) (*rancherClient.Servi
 		return nil, err
 	}
 
-	if err := WaitService(s.rancherClient, service); err != nil {
+	if err := WaitService(ctx, s.rancherClient, service); err != nil {
 		return nil, err
 	}
 
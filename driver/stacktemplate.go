@@ -0,0 +1,126 @@
+package driver
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// Bump whenever DockerComposeTemplate changes so that volumes created from an older version can be found
+	builtinTemplateVersion = "1"
+)
+
+// StackTemplate is the docker-compose template that volume stacks are created from and the version recorded in each
+// stack created from it
+type StackTemplate struct {
+	Version  string
+	template *template.Template
+}
+
+// LoadStackTemplate parses and validates a compose template supplied by the operator. If content is empty the built
+// in template is used. If version is empty, one is derived from the template's content so that any change to the
+// template results in a new version.
+func LoadStackTemplate(content, version string) (*StackTemplate, error) {
+	if content == "" {
+		return &StackTemplate{
+			Version:  builtinTemplateVersion,
+			template: composeTemplate,
+		}, nil
+	}
+
+	tmplt, err := template.New("compose").Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing compose template: %v", err)
+	}
+
+	if version == "" {
+		version = fmt.Sprintf("custom-%x", md5.Sum([]byte(content)))[:15]
+	}
+
+	t := &StackTemplate{
+		Version:  version,
+		template: tmplt,
+	}
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *StackTemplate) render(config volumeConfig) (string, error) {
+	dockerCompose := new(bytes.Buffer)
+	if err := t.template.Execute(dockerCompose, config); err != nil {
+		return "", fmt.Errorf("Error generating docker compose: %v", err)
+	}
+	return dockerCompose.String(), nil
+}
+
+// Configs covering the template's branches that a template must be able to render
+var sampleVolumeConfigs = []volumeConfig{
+	{Name: "sample", Size: "10737418240", SizeGB: "10"},
+	{Name: "sample", Size: "0", SizeGB: "0", DontFormat: true},
+	{Name: "sample", Size: "10737418240", SizeGB: "10", ReadIOPS: "1000", WriteIOPS: "1000", Replicas: 3},
+	{Name: "sample", ReplicaBaseImage: "rancher/vm-ubuntu"},
+	{Name: "sample", Size: "10737418240", SizeGB: "10", FsType: "xfs", Encrypted: true, EncryptionKeySecret: "key"},
+}
+
+// validate renders the template with sample volume configs and checks the result has the controller service and the
+// metadata on it that the driver finds volumes by
+func (t *StackTemplate) validate() error {
+	for _, config := range sampleVolumeConfigs {
+		compose, err := t.render(config)
+		if err != nil {
+			return fmt.Errorf("Compose template version %v failed to render %+v: %v", t.Version, config, err)
+		}
+		if err := validateCompose(compose, config); err != nil {
+			return fmt.Errorf("Compose template version %v rendered with %+v is invalid: %v", t.Version, config, err)
+		}
+	}
+	return nil
+}
+
+func validateCompose(compose string, config volumeConfig) error {
+	services := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(compose), &services); err != nil {
+		return fmt.Errorf("Error parsing compose: %v", err)
+	}
+	if _, ok := services["controller"].(map[interface{}]interface{}); !ok {
+		return fmt.Errorf("There is no controller service.")
+	}
+
+	volume, ok := lookup(services, "controller", "metadata", "volume").(map[interface{}]interface{})
+	if !ok {
+		return fmt.Errorf("The controller service has no volume metadata.")
+	}
+	for key, variable := range map[string]string{"volume_name": composeVolumeName, "template_version": composeTemplateVersion} {
+		if v := volume[key]; v != "$"+variable && v != "${"+variable+"}" {
+			return fmt.Errorf("The controller's volume metadata must set %v to $%v, not %v.", key, variable, v)
+		}
+	}
+
+	// volume_config is the volume's config in JSON, which YAML parses as a map
+	volumeConfig, ok := volume["volume_config"].(map[interface{}]interface{})
+	if !ok || volumeConfig["name"] != config.Name {
+		return fmt.Errorf("The controller's volume metadata must set volume_config to {{.JSON}}.")
+	}
+	return nil
+}
+
+// lookup returns the value at the path of keys in nested YAML maps, or nil if there is none
+func lookup(m interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		switch mm := m.(type) {
+		case map[string]interface{}:
+			m = mm[key]
+		case map[interface{}]interface{}:
+			m = mm[key]
+		default:
+			return nil
+		}
+	}
+	return m
+}
@@ -0,0 +1,51 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadStackTemplate(t *testing.T) {
+	builtin, err := LoadStackTemplate("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if builtin.Version != builtinTemplateVersion {
+		t.Fatalf("Version is: %v. Expected %v", builtin.Version, builtinTemplateVersion)
+	}
+	if err := builtin.validate(); err != nil {
+		t.Fatalf("Built in template is invalid: %v", err)
+	}
+
+	custom, err := LoadStackTemplate(DockerComposeTemplate+"\n# custom\n", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := LoadStackTemplate(DockerComposeTemplate+"\n# custom\n", "")
+	if !strings.HasPrefix(custom.Version, "custom-") || custom.Version != again.Version {
+		t.Fatalf("Unexpected derived versions %v and %v", custom.Version, again.Version)
+	}
+
+	named, err := LoadStackTemplate(DockerComposeTemplate, "2017-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if named.Version != "2017-01" {
+		t.Fatalf("Version is: %v. Expected 2017-01", named.Version)
+	}
+
+	invalid := []string{
+		"replica:\n    scale: {{.Replicas}\n",
+		"replica:\n    scale: {{.ReplicaCount}}\n",
+		"controller:\n    image: {{.NoSuchField}}\n",
+		"controller:\n    image: longhorn\n",
+		strings.Replace(DockerComposeTemplate, "volume_config: {{.JSON}}", "", 1),
+		strings.Replace(DockerComposeTemplate, "template_version: $TEMPLATE_VERSION", "", 1),
+		strings.Replace(DockerComposeTemplate, "volume_name: $VOLUME_NAME\n          volume_config", "volume_config", 1),
+	}
+	for _, content := range invalid {
+		if _, err := LoadStackTemplate(content, ""); err == nil {
+			t.Fatalf("Expected error for template %q", content)
+		}
+	}
+}
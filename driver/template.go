@@ -3,7 +3,7 @@ package driver
 const (
 	DockerComposeTemplate = `
 replica:
-    scale: 2
+    scale: {{.ReplicaCount}}
     image: {{if .ReplicaBaseImage}}{{.ReplicaBaseImage}}{{else}}$IMAGE{{end}}
     entrypoint:
     {{if .ReplicaBaseImage -}}
@@ -60,7 +60,7 @@ replica:
         response_timeout: 50000
         strategy: recreateOnQuorum
         recreate_on_quorum_strategy_config:
-            quorum: 1
+            quorum: {{.Quorum}}
 
 {{- if .ReplicaBaseImage}}
 
@@ -128,7 +128,7 @@ controller:
     - --listen
     - 0.0.0.0:9501
     - --frontend
-    - tcmu
+    - {{.FrontendName}}
     - $VOLUME_NAME
     privileged: true
     volumes:
@@ -143,6 +143,7 @@ controller:
         volume:
           volume_name: $VOLUME_NAME
           volume_config: {{.JSON}}
+          template_version: $TEMPLATE_VERSION
     health_check:
         healthy_threshold: 1
         unhealthy_threshold: 2
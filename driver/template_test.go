@@ -3,6 +3,7 @@ package driver
 import (
 	"bytes"
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -28,3 +29,38 @@ func TestTemplateParses(t *testing.T) {
 	}
 	fmt.Printf("%s", dockerCompose)
 }
+
+func TestTemplateReplicas(t *testing.T) {
+	volConf := volumeConfig{
+		Name:     "foo",
+		Replicas: 3,
+	}
+	dockerCompose := new(bytes.Buffer)
+	if err := composeTemplate.Execute(dockerCompose, volConf); err != nil {
+		t.Fatalf("Error while executing template %v", err)
+	}
+	if !strings.Contains(dockerCompose.String(), "scale: 3\n") || !strings.Contains(dockerCompose.String(), "quorum: 2\n") {
+		t.Fatalf("Expected scale 3 and quorum 2 in:\n%s", dockerCompose)
+	}
+
+	volConf.Replicas = 0
+	dockerCompose = new(bytes.Buffer)
+	if err := composeTemplate.Execute(dockerCompose, volConf); err != nil {
+		t.Fatalf("Error while executing template %v", err)
+	}
+	if !strings.Contains(dockerCompose.String(), "scale: 2\n") || !strings.Contains(dockerCompose.String(), "quorum: 1\n") {
+		t.Fatalf("Expected scale 2 and quorum 1 in:\n%s", dockerCompose)
+	}
+}
+
+func TestTemplateFrontend(t *testing.T) {
+	for frontend, expected := range map[string]string{"": "tcmu", "tgt": "tgt"} {
+		dockerCompose := new(bytes.Buffer)
+		if err := composeTemplate.Execute(dockerCompose, volumeConfig{Name: "foo", Frontend: frontend}); err != nil {
+			t.Fatalf("Error while executing template %v", err)
+		}
+		if !strings.Contains(dockerCompose.String(), "- --frontend\n    - "+expected+"\n") {
+			t.Fatalf("Expected frontend %v in:\n%s", expected, dockerCompose)
+		}
+	}
+}
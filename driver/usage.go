@@ -0,0 +1,64 @@
+package driver
+
+import (
+	"fmt"
+	"strconv"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// VolumeUsage is the size a volume was provisioned with and, while it's mounted on this host, how full its
+// filesystem is
+type VolumeUsage struct {
+	ProvisionedBytes int64            `json:"provisionedBytes"`
+	Filesystem       *FilesystemUsage `json:"filesystem,omitempty"`
+}
+
+type FilesystemUsage struct {
+	TotalBytes uint64 `json:"totalBytes"`
+	UsedBytes  uint64 `json:"usedBytes"`
+	// Available to unprivileged users, which excludes blocks reserved for root
+	AvailableBytes uint64 `json:"availableBytes"`
+	TotalInodes    uint64 `json:"totalInodes"`
+	UsedInodes     uint64 `json:"usedInodes"`
+	FreeInodes     uint64 `json:"freeInodes"`
+}
+
+// volumeUsage returns the usage of a volume. Filesystem usage is only reported for volumes mounted on this host, and
+// is left out if it can't be read.
+func volumeUsage(name, mountpoint string, config volumeConfig) *VolumeUsage {
+	usage := &VolumeUsage{}
+	if config.Size != "" {
+		size, err := strconv.ParseInt(config.Size, 10, 64)
+		if err != nil {
+			logrus.Warnf("Invalid size %v in the config of volume %v: %v", config.Size, name, err)
+		}
+		usage.ProvisionedBytes = size
+	}
+
+	if mountpoint != "" {
+		fs, err := statfs(mountpoint)
+		if err != nil {
+			logrus.Warnf("Couldn't get filesystem usage of volume %v: %v", name, err)
+		}
+		usage.Filesystem = fs
+	}
+	return usage
+}
+
+func statfs(path string) (*FilesystemUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return nil, fmt.Errorf("Error getting filesystem statistics of %v: %v", path, err)
+	}
+	bsize := uint64(st.Bsize)
+	return &FilesystemUsage{
+		TotalBytes:     st.Blocks * bsize,
+		UsedBytes:      (st.Blocks - st.Bfree) * bsize,
+		AvailableBytes: st.Bavail * bsize,
+		TotalInodes:    st.Files,
+		UsedInodes:     st.Files - st.Ffree,
+		FreeInodes:     st.Ffree,
+	}, nil
+}
@@ -0,0 +1,36 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestVolumeUsage(t *testing.T) {
+	usage := volumeUsage("vol1", "", volumeConfig{Size: "10737418240"})
+	if usage.ProvisionedBytes != 10737418240 || usage.Filesystem != nil {
+		t.Fatalf("Unexpected usage of unmounted volume %+v", usage)
+	}
+
+	dir, err := ioutil.TempDir("", "usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	usage = volumeUsage("vol1", dir, volumeConfig{})
+	if usage.ProvisionedBytes != 0 {
+		t.Fatalf("Expected no provisioned size, got %v", usage.ProvisionedBytes)
+	}
+	fs := usage.Filesystem
+	if fs == nil || fs.TotalBytes == 0 || fs.UsedBytes > fs.TotalBytes || fs.AvailableBytes > fs.TotalBytes ||
+		fs.UsedInodes+fs.FreeInodes != fs.TotalInodes {
+		t.Fatalf("Unexpected filesystem usage %+v", fs)
+	}
+
+	// Usage of a filesystem that can't be read is left out
+	usage = volumeUsage("vol1", dir+"/missing", volumeConfig{})
+	if usage.Filesystem != nil {
+		t.Fatalf("Expected no filesystem usage, got %+v", usage.Filesystem)
+	}
+}
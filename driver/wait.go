@@ -1,6 +1,7 @@
 package driver
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -8,8 +9,8 @@ import (
 	rancherClient "github.com/rancher/go-rancher/client"
 )
 
-func WaitFor(client *rancherClient.RancherClient, resource *rancherClient.Resource, output interface{}, transitioning func() string) error {
-	return util.Backoff(60*time.Minute, fmt.Sprintf("Failed waiting for %s:%s", resource.Type, resource.Id), func() (bool, error) {
+func WaitFor(ctx context.Context, client *rancherClient.RancherClient, resource *rancherClient.Resource, output interface{}, transitioning func() string) error {
+	return util.Backoff(ctx, 60*time.Minute, fmt.Sprintf("Failed waiting for %s:%s", resource.Type, resource.Id), func() (bool, error) {
 		err := client.Reload(resource, output)
 		if err != nil {
 			return false, err
@@ -21,14 +22,14 @@ func WaitFor(client *rancherClient.RancherClient, resource *rancherClient.Resour
 	})
 }
 
-func WaitService(client *rancherClient.RancherClient, service *rancherClient.Service) error {
-	return WaitFor(client, &service.Resource, service, func() string {
+func WaitService(ctx context.Context, client *rancherClient.RancherClient, service *rancherClient.Service) error {
+	return WaitFor(ctx, client, &service.Resource, service, func() string {
 		return service.Transitioning
 	})
 }
 
-func WaitEnvironment(client *rancherClient.RancherClient, env *rancherClient.Environment) error {
-	return WaitFor(client, &env.Resource, env, func() string {
+func WaitEnvironment(ctx context.Context, client *rancherClient.RancherClient, env *rancherClient.Environment) error {
+	return WaitFor(ctx, client, &env.Resource, env, func() string {
 		return env.Transitioning
 	})
 }
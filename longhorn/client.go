@@ -0,0 +1,302 @@
+package longhorn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/docker-longhorn-driver/metrics"
+	"github.com/rancher/docker-longhorn-driver/util"
+	"github.com/rancher/go-rancher/client"
+)
+
+// NewVolumeClient returns a client for the API of the controller in the given volume's stack
+func NewVolumeClient(volumeName string) *VolumeClient {
+	url := fmt.Sprintf("http://controller.%v.rancher.internal/v1", util.VolumeToStackName(volumeName))
+	return &VolumeClient{
+		baseURL: url,
+	}
+}
+
+type VolumeClient struct {
+	baseURL string
+}
+
+func (c *VolumeClient) ReloadStatus(ctx context.Context, s *Status) (*Status, error) {
+	self, ok := s.Links["self"]
+	if !ok {
+		return nil, fmt.Errorf("Status doesn't have self link.")
+	}
+
+	req, err := http.NewRequest("GET", self, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	stat := &Status{}
+	err = json.NewDecoder(resp.Body).Decode(stat)
+	if err != nil {
+		return nil, err
+	}
+
+	return stat, nil
+}
+
+// WaitForStatus polls the status of a long running operation such as a backup or restore until it is done or has
+// failed and returns the final status
+func (c *VolumeClient) WaitForStatus(ctx context.Context, s *Status, timeout time.Duration, operation string) (_ *Status, err error) {
+	defer metrics.Observe("longhorn", "wait_for_status", time.Now(), &err)
+	final := s
+	err = util.Backoff(ctx, timeout, fmt.Sprintf("Failed waiting for %v", operation), func() (bool, error) {
+		current, err := c.ReloadStatus(ctx, s)
+		if err != nil {
+			return false, err
+		}
+		if current.State == "done" {
+			final = current
+			return true, nil
+		} else if current.State == "error" {
+			return false, fmt.Errorf("%v failed. Status: %v", operation, current.Message)
+		}
+		return false, nil
+	})
+	return final, err
+}
+
+func (c *VolumeClient) RevertToSnapshot(ctx context.Context, name string) (_ *Volume, err error) {
+	defer metrics.Observe("longhorn", "revert_to_snapshot", time.Now(), &err)
+	var resp Volume
+	request := &Snapshot{
+		Name: name,
+	}
+	err = c.post(ctx, "/volumes/1?action=reverttosnapshot", request, &resp)
+	return &resp, err
+}
+
+func (c *VolumeClient) Resize(ctx context.Context, size string) (_ *Volume, err error) {
+	defer metrics.Observe("longhorn", "resize", time.Now(), &err)
+	var resp Volume
+	request := &resizeInput{
+		Size: size,
+	}
+	err = c.post(ctx, "/volumes/1?action=resize", request, &resp)
+	return &resp, err
+}
+
+func (c *VolumeClient) RemoveBackup(ctx context.Context, snapshotUUID, uuid, location string, target BackupTarget) (_ *Status, err error) {
+	defer metrics.Observe("longhorn", "remove_backup", time.Now(), &err)
+	request := &locationInput{
+		UUID:         uuid,
+		Location:     location,
+		BackupTarget: target,
+	}
+	if err := c.post(ctx, fmt.Sprintf("/snapshots/%v?action=removebackup", snapshotUUID), request, nil); err != nil {
+		if apiErr, ok := err.(APIError); ok && apiErr.statusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (c *VolumeClient) CreateBackup(ctx context.Context, snapshotUUID, uuid string, target BackupTarget) (_ *Status, err error) {
+	defer metrics.Observe("longhorn", "create_backup", time.Now(), &err)
+	var resp Status
+	request := &backupInput{
+		UUID:         uuid,
+		BackupTarget: target,
+	}
+	err = c.post(ctx, fmt.Sprintf("/snapshots/%v?action=backup", snapshotUUID), request, &resp)
+	return &resp, err
+}
+
+func (c *VolumeClient) RestoreFromBackup(ctx context.Context, uuid, location string, target BackupTarget) (_ *Status, err error) {
+	defer metrics.Observe("longhorn", "restore_from_backup", time.Now(), &err)
+	var resp Status
+	request := &locationInput{
+		UUID:         uuid,
+		Location:     location,
+		BackupTarget: target,
+	}
+
+	err = c.post(ctx, "/volumes/1?action=restorefrombackup", request, &resp)
+	return &resp, err
+}
+
+func (c *VolumeClient) ListSnapshots(ctx context.Context) (_ []Snapshot, err error) {
+	defer metrics.Observe("longhorn", "list_snapshots", time.Now(), &err)
+	var resp SnapshotCollection
+	err = c.get(ctx, "/snapshots", &resp)
+	return resp.Data, err
+}
+
+func (c *VolumeClient) GetSnapshot(ctx context.Context, name string) (_ *Snapshot, err error) {
+	defer metrics.Observe("longhorn", "get_snapshot", time.Now(), &err)
+	var resp Snapshot
+	err = c.get(ctx, fmt.Sprintf("/snapshots/%v", name), &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+func (c *VolumeClient) CreateSnapshot(ctx context.Context, name string) (_ *Snapshot, err error) {
+	defer metrics.Observe("longhorn", "create_snapshot", time.Now(), &err)
+	var resp Snapshot
+	request := &Snapshot{
+		Name: name,
+	}
+	err = c.post(ctx, "/snapshots", request, &resp)
+	return &resp, err
+}
+
+func (c *VolumeClient) DeleteSnapshot(ctx context.Context, name string) (err error) {
+	defer metrics.Observe("longhorn", "delete_snapshot", time.Now(), &err)
+	if err := c.do(ctx, "DELETE", fmt.Sprintf("/snapshots/%v", name), nil, nil); err != nil {
+		if apiErr, ok := err.(APIError); ok && apiErr.statusCode == http.StatusNotFound {
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (c *VolumeClient) get(ctx context.Context, path string, obj interface{}) error {
+	req, err := http.NewRequest("GET", c.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(obj)
+}
+
+func (c *VolumeClient) post(ctx context.Context, path string, req, resp interface{}) error {
+	return c.do(ctx, "POST", path, req, resp)
+}
+
+func (c *VolumeClient) put(ctx context.Context, path string, req, resp interface{}) error {
+	return c.do(ctx, "PUT", path, req, resp)
+}
+
+func (c *VolumeClient) do(ctx context.Context, method, path string, req, resp interface{}) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	bodyType := "application/json"
+	url := c.baseURL + path
+
+	logrus.Debugf("%s %s", method, url)
+	httpReq, err := http.NewRequest(method, url, bytes.NewBuffer(b))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", bodyType)
+
+	httpResp, err := http.DefaultClient.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode >= 300 {
+		return newAPIError(httpResp)
+	}
+
+	if resp == nil {
+		return nil
+	}
+
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+func newAPIError(resp *http.Response) APIError {
+	content, _ := ioutil.ReadAll(resp.Body)
+	msg := fmt.Sprintf("Bad response: %d %s: %s", resp.StatusCode, resp.Status, content)
+	return APIError{
+		statusCode: resp.StatusCode,
+		status:     resp.Status,
+		errorMsg:   msg,
+	}
+}
+
+type APIError struct {
+	statusCode int
+	status     string
+	errorMsg   string
+}
+
+func (e APIError) Error() string {
+	return e.errorMsg
+}
+
+// StatusCode is the HTTP status code of the controller's response
+func (e APIError) StatusCode() int {
+	return e.statusCode
+}
+
+type Volume struct {
+	client.Resource
+	Name string `json:"name,omitempty"`
+}
+
+type resizeInput struct {
+	Size string `json:"size,omitempty"`
+}
+
+type backupInput struct {
+	UUID         string       `json:"uuid,omitempty"`
+	BackupTarget BackupTarget `json:"backupTarget,omitempty"`
+}
+
+type locationInput struct {
+	UUID         string       `json:"uuid,omitempty"`
+	Location     string       `json:"location,omitempty"`
+	BackupTarget BackupTarget `json:"backupTarget,omitempty"`
+}
+
+type Snapshot struct {
+	client.Resource
+	Name string `json:"name,omitempty"`
+}
+
+type SnapshotCollection struct {
+	client.Collection
+	Data []Snapshot `json:"data"`
+}
+
+type Status struct {
+	client.Resource
+	State   string `json:"state,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type BackupTarget struct {
+	Name      string    `json:"name,omitempty"`
+	UUID      string    `json:"uuid,omitempty"`
+	NFSConfig NFSConfig `json:"nfsConfig,omitempty"`
+}
+
+type NFSConfig struct {
+	Server       string `json:"server"`
+	Share        string `json:"share"`
+	MountOptions string `json:"mountOptions"`
+}
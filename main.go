@@ -8,6 +8,7 @@ import (
 
 	"github.com/rancher/kubernetes-agent/healthcheck"
 
+	"github.com/rancher/docker-longhorn-driver/audit"
 	"github.com/rancher/docker-longhorn-driver/docker/volumeplugin"
 	"github.com/rancher/docker-longhorn-driver/storagepool"
 )
@@ -43,11 +44,29 @@ func main() {
 			Usage:  "The secret key required to authenticate with cattle server",
 			EnvVar: "CATTLE_SECRET_KEY",
 		},
+		cli.StringFlag{
+			Name:   "driver-api-token",
+			Usage:  "token that clients of the driver's management API must present",
+			EnvVar: "DRIVER_API_TOKEN",
+		},
+		cli.StringFlag{
+			Name:  "driver-api-token-file",
+			Usage: "file to read --driver-api-token from, such as a Rancher secret",
+		},
+		cli.StringFlag{
+			Name:  "driver-api-ca",
+			Usage: "CA that signs the certificates the driver's management API and its clients present over TLS",
+		},
 		cli.IntFlag{
 			Name:  "healthcheck-interval",
 			Value: 5000,
 			Usage: "set the frequency of performing healthchecks",
 		},
+		cli.StringFlag{
+			Name:  "metrics-listen",
+			Value: ":9105",
+			Usage: "address to serve Prometheus metrics on at /metrics. Empty to disable",
+		},
 		cli.StringFlag{
 			Name:  "metadata-url",
 			Usage: "set the metadata url",
@@ -55,13 +74,19 @@ func main() {
 		},
 	}
 
-	commands := []cli.Command{volumeplugin.Command, storagepool.Command}
+	commands := []cli.Command{volumeplugin.Command, storagepool.Command, audit.Command}
 	app.Commands = commands
 
-	go func() {
-		err := healthcheck.StartHealthCheck(healthCheckPort)
-		logrus.Fatalf("Error while running healthcheck [%v]", err)
-	}()
+	app.Before = func(c *cli.Context) error {
+		// Querying the audit log runs next to the driver, which already serves the health check
+		if c.Args().First() != audit.Command.Name {
+			go func() {
+				err := healthcheck.StartHealthCheck(healthCheckPort)
+				logrus.Fatalf("Error while running healthcheck [%v]", err)
+			}()
+		}
+		return nil
+	}
 	app.Run(os.Args)
 
 }
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Buckets for operations that take anywhere from milliseconds to hours, such as stack creation and backups
+var OperationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600, 14400}
+
+// Default is the registry served by Handler and that the operation metrics are recorded in
+var Default = prometheus.NewRegistry()
+
+var (
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "longhorn_operation_duration_seconds",
+		Help:    "Time taken by driver, Cattle event and Longhorn controller operations.",
+		Buckets: OperationBuckets,
+	}, []string{"component", "operation"})
+	operationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "longhorn_operation_errors_total",
+		Help: "Number of driver, Cattle event and Longhorn controller operations that failed.",
+	}, []string{"component", "operation"})
+)
+
+func init() {
+	Default.MustRegister(operationDuration, operationErrors)
+}
+
+// Observe records how long an operation took and whether it failed. It's meant to be deferred with a pointer to the
+// caller's named error result:
+//
+//	defer metrics.Observe("driver", "create", time.Now(), &err)
+func Observe(component, operation string, start time.Time, err *error) {
+	operationDuration.WithLabelValues(component, operation).Observe(time.Since(start).Seconds())
+	if err != nil && *err != nil {
+		operationErrors.WithLabelValues(component, operation).Inc()
+	}
+}
+
+// Handler serves the metrics in the default registry
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Default, promhttp.HandlerOpts{})
+}
+
+// ListenAndServe serves /metrics on the given address
+func ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	logrus.Infof("Serving metrics on %v", addr)
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObserve(t *testing.T) {
+	func() (err error) {
+		defer Observe("test", "fail", time.Now(), &err)
+		return fmt.Errorf("failed")
+	}()
+	func() (err error) {
+		defer Observe("test", "succeed", time.Now(), &err)
+		return nil
+	}()
+
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := string(body)
+
+	if !strings.Contains(output, `longhorn_operation_errors_total{component="test",operation="fail"} 1`) {
+		t.Fatalf("Expected failure to be counted:\n%s", output)
+	}
+	if strings.Contains(output, `longhorn_operation_errors_total{component="test",operation="succeed"}`) {
+		t.Fatalf("Expected success not to be counted as an error:\n%s", output)
+	}
+	if !strings.Contains(output, `longhorn_operation_duration_seconds_count{component="test",operation="succeed"} 1`) {
+		t.Fatalf("Expected duration of success to be recorded:\n%s", output)
+	}
+}
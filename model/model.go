@@ -1,7 +1,25 @@
 package model
 
+// States of a volume as seen from the host reporting it
+const (
+	// The volume's stack is being created, or its controller moved to this host
+	StateCreating = "creating"
+	// The volume's stack is being deleted
+	StateDeleting = "deleting"
+	// The volume was on this host but its controller has moved to another
+	StateMoved = "moved"
+	// Fewer of the volume's replicas are healthy than it has. The volume may still be mounted.
+	StateDegraded = "degraded"
+	StateMounted  = "mounted"
+	// The volume's device is on this host but isn't mounted
+	StateAttached = "attached"
+	StateDetached = "detached"
+)
+
 type Volume struct {
-	Name       string `json:"name"`
+	Name string `json:"name"`
+	// Empty unless the volume is mounted on this host
 	Mountpoint string
 	Opts       map[string]string
+	State      string
 }
@@ -5,6 +5,7 @@ import (
 
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rancher/docker-longhorn-driver/cattle"
 )
 
@@ -12,13 +13,16 @@ type Agent struct {
 	healthCheckInterval int
 	driver              string
 	cattleClient        cattle.StoragePoolManager
+	// The number of hosts in the storage pool, as last reported to Cattle
+	hosts prometheus.Gauge
 }
 
-func NewStoragepoolAgent(healthCheckInterval int, driver string, cattleClient cattle.StoragePoolManager) *Agent {
+func NewStoragepoolAgent(healthCheckInterval int, driver string, cattleClient cattle.StoragePoolManager, hosts prometheus.Gauge) *Agent {
 	return &Agent{
 		healthCheckInterval: healthCheckInterval,
 		driver:              driver,
 		cattleClient:        cattleClient,
+		hosts:               hosts,
 	}
 }
 
@@ -38,6 +42,7 @@ func (s *Agent) Run(metadataURL string) error {
 		if err != nil {
 			return fmt.Errorf("Error while reading host info [%v]", err)
 		}
+		s.hosts.Set(float64(len(currHosts)))
 
 		toSend := map[string]bool{}
 		for uuid := range currHosts {
@@ -1,11 +1,15 @@
 package storagepool
 
 import (
+	"time"
+
 	"github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/rancher/docker-longhorn-driver/cattle"
 	"github.com/rancher/docker-longhorn-driver/cattleevents"
+	"github.com/rancher/docker-longhorn-driver/metrics"
 	"github.com/rancher/docker-longhorn-driver/util"
 )
 
@@ -13,6 +17,26 @@ var Command = cli.Command{
 	Name:   "storagepool",
 	Usage:  "Start convoy-agent as a storagepool agent",
 	Action: start,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "driver-api-url",
+			Value: "http://driver",
+			Usage: "http://, https:// or unix:// URL of the volume driver's management API",
+		},
+		cli.StringFlag{
+			Name:  "driver-api-tls-cert",
+			Usage: "client certificate to present to the driver's management API over TLS",
+		},
+		cli.StringFlag{
+			Name:  "driver-api-tls-key",
+			Usage: "key of --driver-api-tls-cert",
+		},
+		cli.IntFlag{
+			Name:  "event-timeout",
+			Value: 46800,
+			Usage: "seconds after which the handling of a Cattle event is cancelled. Backups and restores wait up to 12 hours",
+		},
+	},
 }
 
 func start(c *cli.Context) {
@@ -33,10 +57,28 @@ func start(c *cli.Context) {
 		logrus.Fatalf("Unable to get metadata: %v", err)
 	}
 
+	token, err := util.ReadToken(c.GlobalString("driver-api-token"), c.GlobalString("driver-api-token-file"))
+	if err != nil {
+		logrus.Fatalf("Unable to read API token: %v", err)
+	}
+
+	hosts := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "longhorn_storage_pool_hosts",
+		Help: "Number of hosts in the storage pool.",
+	})
+	metrics.Default.MustRegister(hosts)
+	if addr := c.GlobalString("metrics-listen"); addr != "" {
+		go func() {
+			err := metrics.ListenAndServe(addr)
+			logrus.Errorf("Metrics server exited with error: %v", err)
+		}()
+	}
+
+	ctx := util.ShutdownContext()
 	resultChan := make(chan error)
 
 	go func(rc chan error) {
-		storagePoolAgent := NewStoragepoolAgent(healthCheckInterval, md.DriverName, cattleClient)
+		storagePoolAgent := NewStoragepoolAgent(healthCheckInterval, md.DriverName, cattleClient, hosts)
 		err := storagePoolAgent.Run(metadataURL)
 		logrus.Errorf("Error while running storage pool agent [%v]", err)
 		rc <- err
@@ -48,8 +90,16 @@ func start(c *cli.Context) {
 			CattleAccessKey: cattleAccessKey,
 			CattleSecretKey: cattleSecretKey,
 			WorkerCount:     10,
+			DriverAPI: cattleevents.DriverAPIConfig{
+				URL:     c.String("driver-api-url"),
+				Token:   token,
+				TLSCert: c.String("driver-api-tls-cert"),
+				TLSKey:  c.String("driver-api-tls-key"),
+				TLSCA:   c.GlobalString("driver-api-ca"),
+			},
+			EventTimeout: time.Duration(c.Int("event-timeout")) * time.Second,
 		}
-		err := cattleevents.ConnectToEventStream(conf)
+		err := cattleevents.ConnectToEventStream(ctx, conf)
 		logrus.Errorf("Cattle event listener exited with error: %s", err)
 		rc <- err
 	}(resultChan)
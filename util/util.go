@@ -1,15 +1,25 @@
 package util
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/docker/go-units"
 
 	"crypto/md5"
+	"crypto/rand"
 	"github.com/rancher/go-rancher-metadata/metadata"
 	"strings"
 )
@@ -24,9 +34,11 @@ var (
 )
 
 type MetadataConfig struct {
-	DriverName    string
-	Image         string
-	ContainerName string
+	DriverName      string
+	Image           string
+	Template        string
+	TemplateVersion string
+	ContainerName   string
 }
 
 func GetMetadataConfig(metadataURL string) (MetadataConfig, error) {
@@ -49,6 +61,12 @@ func GetMetadataConfig(metadataURL string) (MetadataConfig, error) {
 	if image, ok := svc.Metadata["VOLUME_STACK_IMAGE"]; ok {
 		config.Image = fmt.Sprintf("%v", image)
 	}
+	if template, ok := svc.Metadata["VOLUME_STACK_TEMPLATE"]; ok {
+		config.Template = fmt.Sprintf("%v", template)
+	}
+	if version, ok := svc.Metadata["VOLUME_STACK_TEMPLATE_VERSION"]; ok {
+		config.TemplateVersion = fmt.Sprintf("%v", version)
+	}
 
 	c, err := client.GetSelfContainer()
 	if err != nil {
@@ -123,7 +141,8 @@ func VolumeToStackName(volumeName string) string {
 	return stackName
 }
 
-func Backoff(maxDuration time.Duration, timeoutMessage string, f func() (bool, error)) error {
+// Backoff calls f with increasing intervals until it's done, fails, maxDuration passes or ctx is cancelled
+func Backoff(ctx context.Context, maxDuration time.Duration, timeoutMessage string, f func() (bool, error)) error {
 	startTime := time.Now()
 	waitTime := 150 * time.Millisecond
 	maxWaitTime := 2 * time.Second
@@ -138,7 +157,11 @@ func Backoff(maxDuration time.Duration, timeoutMessage string, f func() (bool, e
 			return nil
 		}
 
-		time.Sleep(waitTime)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%v: %v", timeoutMessage, ctx.Err())
+		case <-time.After(waitTime):
+		}
 
 		waitTime *= 2
 		if waitTime > maxWaitTime {
@@ -146,3 +169,82 @@ func Backoff(maxDuration time.Duration, timeoutMessage string, f func() (bool, e
 		}
 	}
 }
+
+// RandomID returns a random ID in UUID format
+func RandomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// The system's random source failing is not something we can recover from
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// NewTLSConfig loads the certificate and key, if given, to present to the other side of a connection and the CA, if
+// given, that the other side's certificate must be signed by
+func NewTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't load certificate %v and key %v. Error: %v", certFile, keyFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read CA certificate %v. Error: %v", caFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %v", caFile)
+		}
+		config.RootCAs = pool
+		config.ClientCAs = pool
+	}
+	return config, nil
+}
+
+// ReadToken returns the token if it's set and otherwise reads it from tokenFile, which may be a Rancher secret
+func ReadToken(token, tokenFile string) (string, error) {
+	if token != "" || tokenFile == "" {
+		return token, nil
+	}
+	content, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't read token file %v. Error: %v", tokenFile, err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// ShutdownContext returns a context that is cancelled when the process is asked to stop
+func ShutdownContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logrus.Infof("Received %v. Cancelling operations in progress.", sig)
+		cancel()
+	}()
+	return ctx
+}
+
+// WaitTimeout waits for the wait group for up to timeout and returns whether it finished
+func WaitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -1,7 +1,9 @@
 package util
 
 import (
+	"context"
 	"testing"
+	"time"
 )
 
 func TestConvertSize(t *testing.T) {
@@ -41,3 +43,21 @@ func TestConvertSize(t *testing.T) {
 		t.Fatalf("SizeGB is: %v. Expected 1", sizeGB)
 	}
 }
+
+func TestBackoffCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := Backoff(ctx, time.Hour, "Failed waiting", func() (bool, error) {
+		calls++
+		if calls == 2 {
+			cancel()
+		}
+		return false, nil
+	})
+	if err == nil {
+		t.Fatal("Expected error after cancellation")
+	}
+	if calls != 2 {
+		t.Fatalf("Expected 2 calls before cancellation was noticed, got %v", calls)
+	}
+}